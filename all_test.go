@@ -14,7 +14,6 @@ import (
 	"strings"
 	"testing"
 	"time"
-	"unsafe"
 
 	"github.com/aryann/difflib"
 	_ "github.com/mattn/go-sqlite3"
@@ -153,7 +152,7 @@ func (app *TestApp) Add(t *testing.T, table *TestTable) error {
 	if index > 0 {
 		tableName = tableName[:index]
 	}
-	app.s.Set(tableName, memcore.MapToTags(table.Tags), time.Now(), innerTable, nil)
+	app.s.Set(tableName, memcore.MapToTags(table.Tags), false, time.Now(), innerTable, nil)
 	return nil
 }
 
@@ -476,3 +475,545 @@ func runTests(t *testing.T, allTests []TestCase) {
 		})
 	}
 }
+
+func TestPseudoColumns(t *testing.T) {
+	storage := memcore.NewStorage()
+	now := time.Now()
+	for mo, ago := range map[string]time.Duration{"1": time.Minute, "2": 10 * time.Minute} {
+		table, err := memcore.ToTable([]map[string]interface{}{{"f1": "a" + mo}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.Set("cpu", []KeyValue{{Key: "mo", Value: mo}}, false, now.Add(-ago), table, nil)
+	}
+	ctx := &Context{
+		Ctx:     context.Background(),
+		Storage: WrapStorage(storage),
+	}
+
+	for _, test := range []struct {
+		sql  string
+		want []string
+	}{
+		{
+			sql:  "select f1, @_table from cpu where @_time > now() - interval 5 minute",
+			want: []string{`"a1","cpu"`},
+		},
+		{
+			sql:  "select f1 from cpu where @_err is null order by @_time",
+			want: []string{`"a2"`, `"a1"`},
+		},
+	} {
+		results, err := Execute(ctx, test.sql)
+		if err != nil {
+			t.Error(test.sql, err)
+			continue
+		}
+		var lines []string
+		for _, r := range results {
+			var sb strings.Builder
+			r.ToLine(&sb, ",")
+			lines = append(lines, sb.String())
+		}
+		if strings.Join(lines, "\n") != strings.Join(test.want, "\n") {
+			t.Error(test.sql, "want", test.want, "got", lines)
+		}
+	}
+}
+
+func TestTagsFromSubquery(t *testing.T) {
+	storage := memcore.NewStorage()
+	now := time.Now()
+	for _, mo := range []string{"1", "2", "3"} {
+		table, err := memcore.ToTable([]map[string]interface{}{{"f1": "a" + mo}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.Set("cpu", []KeyValue{{Key: "mo", Value: mo}}, false, now, table, nil)
+	}
+	table, err := memcore.ToTable([]map[string]interface{}{{"mo": "1"}, {"mo": "3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Set("devices", nil, false, now, table, nil)
+
+	ctx := &Context{
+		Ctx:     context.Background(),
+		Storage: WrapStorage(storage),
+	}
+	results, err := Execute(ctx, "select f1 from cpu where @mo in (select mo from devices) order by f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, r := range results {
+		var sb strings.Builder
+		r.ToLine(&sb, ",")
+		lines = append(lines, sb.String())
+	}
+	if got := strings.Join(lines, ";"); got != `"a1";"a3"` {
+		t.Error("want a1;a3 got", got)
+	}
+
+	// 子查询出错时返回错误, 而不是查询所有的 tag 集
+	_, err = Execute(ctx, "select f1 from cpu where @mo in (select mo from missing)")
+	if err == nil {
+		t.Error("want error got ok")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	storage := memcore.NewStorageWithHistory(memcore.HistoryPolicy{MaxVersions: 2})
+	base := time.Date(2026, 10, 1, 10, 0, 0, 0, time.Local)
+	set := func(mo string, minutes int, value int) {
+		table, err := memcore.ToTable([]map[string]interface{}{{"id": mo, "value": value}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.Set("cpu", []KeyValue{{Key: "mo", Value: mo}}, false, base.Add(time.Duration(minutes)*time.Minute), table, nil)
+	}
+	set("1", 0, 10) // 超过 MaxVersions, 会被丢弃
+	set("1", 1, 11)
+	set("1", 2, 12)
+	set("1", 3, 13)
+	set("2", 1, 21)
+	storage.Set("cpu", []KeyValue{{Key: "mo", Value: "2"}}, false, base.Add(4*time.Minute), Table{}, errors.New("mo 2 is down"))
+
+	ctx := &Context{
+		Ctx:     context.Background(),
+		Storage: WrapStorage(storage),
+	}
+	for _, test := range []struct {
+		sql  string
+		want []string
+	}{
+		{
+			sql:  "select @mo, value from history.cpu order by @mo, @_time",
+			want: []string{`"1",11`, `"1",12`, `"1",13`, `"2",21`},
+		},
+		{
+			sql:  "select value from history.cpu where @mo = '1' and value < 13 order by @_time",
+			want: []string{`11`, `12`},
+		},
+		{
+			sql:  "select @mo, value from cpu as of '2026-10-01 10:02:30' order by @mo",
+			want: []string{`"1",12`, `"2",21`},
+		},
+		{
+			sql:  "select c.value, o.value from cpu as c join cpu as of '2026-10-01 10:01:00' as o on c.id = o.id where c.@mo = '1'",
+			want: []string{`13,11`},
+		},
+	} {
+		results, err := Execute(ctx, test.sql)
+		if err != nil {
+			t.Error(test.sql, err)
+			continue
+		}
+		var lines []string
+		for _, r := range results {
+			var sb strings.Builder
+			r.ToLine(&sb, ",")
+			lines = append(lines, sb.String())
+		}
+		if strings.Join(lines, "\n") != strings.Join(test.want, "\n") {
+			t.Error(test.sql, "want", test.want, "got", lines)
+		}
+	}
+
+	if _, err := Execute(ctx, "select * from cpu as of 'yesterday'"); err == nil {
+		t.Error("want error for invalid AS OF time")
+	}
+}
+
+func TestRewriteAsOf(t *testing.T) {
+	for _, test := range []struct {
+		sql  string
+		want string
+		err  string
+	}{
+		{
+			sql:  "select * from cpu as of '2026-10-01 10:00:00' where @mo = '1'",
+			want: "select * from asof_1.cpu where @mo = '1'",
+		},
+		{
+			sql:  "select * from `cpu` AS OF '2026-10-01 10:00:00' as o",
+			want: "select * from asof_1.`cpu` as o",
+		},
+		{
+			sql:  "select * from cpu where name = 'cpu as of ''2026-10-01'''",
+			want: "select * from cpu where name = 'cpu as of ''2026-10-01'''",
+		},
+		{
+			sql:  "select * from cpu /* cpu as of '2026-10-01' */",
+			want: "select * from cpu /* cpu as of '2026-10-01' */",
+		},
+		{
+			sql: "select * from fdw.cpu as of '2026-10-01 10:00:00'",
+			err: "AS OF isnot supported on table 'fdw.cpu'",
+		},
+		{
+			sql: "select * from asof_1.cpu",
+			err: "table qualifier 'asof_1' is reserved",
+		},
+	} {
+		sqlstr, _, err := rewriteAsOf(test.sql)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Error(test.sql, "want error", test.err, "got", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(test.sql, err)
+			continue
+		}
+		if sqlstr != test.want {
+			t.Error(test.sql, "want", test.want, "got", sqlstr)
+		}
+	}
+}
+
+func TestVectorized(t *testing.T) {
+	storage := memcore.NewStorage()
+	columns := []Column{{Name: "name"}, {Name: "value"}, {Name: "load"}}
+	for mo, records := range map[string][][]Value{
+		"1": {
+			{vm.StringToValue("a"), vm.IntToValue(3), vm.FloatToValue(0.5)},
+			{vm.StringToValue("b"), vm.IntToValue(12), vm.FloatToValue(1.25)},
+			{vm.StringToValue("c"), vm.IntToValue(20)}, // 缺少的 load 是 null
+		},
+		"2": {
+			{vm.StringToValue("a"), vm.IntToValue(7), vm.FloatToValue(2)},
+			{vm.StringToValue("d"), vm.IntToValue(8), vm.FloatToValue(4)},
+		},
+	} {
+		storage.Set("cpu", []KeyValue{{Key: "mo", Value: mo}}, false, time.Now(), Table{Columns: columns, Records: records}, nil)
+	}
+	ctx := &Context{
+		Ctx:     context.Background(),
+		Storage: WrapStorage(storage),
+	}
+
+	for _, test := range []struct {
+		sql  string
+		want string
+	}{
+		{sql: "select count(*), count(value), sum(value), avg(value) from cpu", want: `5,5,50,10`},
+		{sql: "select sum(load) as s, count(load) as c from cpu", want: `7.75,4`},
+		{sql: "select count(*) from cpu where value > 5", want: `4`},
+		{sql: "select sum(value) from cpu where @mo = '1' and 10 <= value", want: `32`},
+		{sql: "select count(*) from cpu where name = 'a' or value >= 20", want: `3`},
+		{sql: "select count(*) from cpu where not (name <> 'a')", want: `2`},
+		{sql: "select count(*) as c from cpu as t where cpu.value > 5", want: `4`},
+		{sql: "select count(*) from cpu where value > 100", want: `0`},
+		{sql: "select COUNT(*), Sum(value) from cpu where cpu.@mo = '1'", want: `3,35`},
+	} {
+		ctx.Debuger = ExecuteTracer{}
+		results, err := Execute(ctx, test.sql)
+		if err != nil {
+			t.Error(test.sql, err)
+			continue
+		}
+		if len(results) != 1 {
+			t.Error(test.sql, "want one record, got", results)
+			continue
+		}
+		var sb strings.Builder
+		results[0].ToLine(&sb, ",")
+		if sb.String() != test.want {
+			t.Error(test.sql, "want", test.want, "got", sb.String())
+		}
+
+		if ctx.Debuger.Batches == 0 && test.want != `0` {
+			t.Error(test.sql, "want vectorized execution, got", ctx.Debuger.Results)
+		}
+	}
+
+	// 按列执行和按行执行的结果相同
+	results, err := Execute(ctx, "select name from cpu where value > 5 and name <> 'c' order by name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range results {
+		names = append(names, r.Values[0].Str)
+	}
+	if strings.Join(names, ",") != "a,b,d" {
+		t.Error("want a,b,d got", names)
+	}
+
+	// tag 的表名和查询的表不同时和列一样返回错误
+	if _, err := Execute(ctx, "select count(*) from cpu where x.@mo = '1'"); err == nil {
+		t.Error("want error for tag of unknown table")
+	}
+
+	// 比较出错时和按行执行一样返回错误
+	if _, err := Execute(ctx, "select count(*) from cpu where value = 'x'"); err == nil {
+		t.Error("want error for comparing int with string")
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	storage := memcore.NewStorage()
+	err := storage.(memcore.SchemaStorage).SetSchema("cpu", &memcore.Schema{
+		Columns: []memcore.ColumnSchema{
+			{Name: "name", Type: vm.ValueString},
+			{Name: "value", Type: vm.ValueInt64},
+		},
+		Tags:   []string{"mo"},
+		Strict: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := []Column{{Name: "name"}, {Name: "value"}}
+	err = storage.Set("cpu", []KeyValue{{Key: "mo", Value: "1"}}, false, time.Now(), Table{Columns: columns, Records: [][]Value{
+		{vm.StringToValue("a"), vm.StringToValue("3")},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Set("disk", []KeyValue{{Key: "mo", Value: "1"}}, false, time.Now(), Table{Columns: []Column{{Name: "path"}}, Records: [][]Value{
+		{vm.StringToValue("/")},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &Context{
+		Ctx:     context.Background(),
+		Storage: WrapStorage(storage),
+	}
+
+	for _, test := range []struct {
+		sql string
+		ok  bool
+	}{
+		{sql: "select sum(value) from cpu where value > 1.5 and @mo = '1'", ok: true},
+		{sql: "select * from cpu where value in (1, '2') and mo = '1'", ok: true},
+		{sql: "select * from cpu where name in (select path from disk where path = '/')", ok: true},
+		{sql: "select * from cpu where value = 'x'"},
+		{sql: "select * from cpu where 'x' <> value"},
+		{sql: "select * from cpu where cpu.unknown = 1"},
+		{sql: "select unknown from cpu"},
+		{sql: "select sum(name) from cpu"},
+		{sql: "select avg(cpu.name) from cpu"},
+	} {
+		_, err := Execute(ctx, test.sql)
+		if test.ok && err != nil {
+			t.Error(test.sql, err)
+		} else if !test.ok && err == nil {
+			t.Error(test.sql, "want error")
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	storage := memcore.NewWatchedStorage(memcore.NewStorage())
+	set := func(tablename, mo string, value int64) {
+		err := storage.Set(tablename, []KeyValue{{Key: "mo", Value: mo}}, false, time.Now(), Table{
+			Columns: []Column{{Name: "value"}},
+			Records: [][]Value{{vm.IntToValue(value)}},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("cpu", "1", 1)
+
+	ctx := &Context{
+		Ctx:     context.Background(),
+		Storage: WrapStorage(storage),
+	}
+	updates := make(chan Update, 10)
+	cq, err := Subscribe(ctx, "select sum(value) as s from cpu", func(u Update) {
+		updates <- u
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cq.Close()
+	if names := cq.Tables(); strings.Join(names, ",") != "cpu" {
+		t.Error("want tables is cpu, got", names)
+	}
+
+	next := func() Update {
+		select {
+		case u := <-updates:
+			if u.Err != nil {
+				t.Fatal(u.Err)
+			}
+			return u
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return Update{}
+	}
+	toLines := func(records []Record) string {
+		var lines []string
+		for _, r := range records {
+			var sb strings.Builder
+			r.ToLine(&sb, ",")
+			lines = append(lines, sb.String())
+		}
+		return strings.Join(lines, ";")
+	}
+
+	u := next()
+	if got := toLines(u.Results); got != "1" {
+		t.Error("first results: want", "1", "got", got)
+	}
+	if got := toLines(u.Added); got != "1" {
+		t.Error("first added: want", "1", "got", got)
+	}
+
+	set("cpu", "2", 2)
+	u = next()
+	if got := toLines(u.Added); got != "3" {
+		t.Error("added: want", "3", "got", got)
+	}
+	if got := toLines(u.Removed); got != "1" {
+		t.Error("removed: want", "1", "got", got)
+	}
+	if len(u.Changes) == 0 || u.Changes[0].Table != "cpu" || u.Changes[0].Op != memcore.ChangeSet {
+		t.Error("changes is invalid", u.Changes)
+	}
+
+	// 其它表的变化和结果没有变化的写入都不会通知
+	set("mem", "1", 10)
+	set("cpu", "2", 2)
+	storage.Delete("cpu", []KeyValue{{Key: "mo", Value: "2"}})
+	u = next()
+	if got := toLines(u.Results); got != "1" {
+		t.Error("results after delete: want", "1", "got", got)
+	}
+	if u.Changes[len(u.Changes)-1].Op != memcore.ChangeDelete {
+		t.Error("want delete change, got", u.Changes)
+	}
+
+	cq.Close()
+	set("cpu", "3", 3)
+	select {
+	case u := <-updates:
+		t.Error("want no update after close, got", u)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := Subscribe(&Context{Storage: WrapStorage(memcore.NewStorage())}, "select * from cpu", func(Update) {}); err == nil {
+		t.Error("want error for storage doesnot support watch")
+	}
+}
+
+func TestMetadataStatements(t *testing.T) {
+	conn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		"CREATE TABLE devices (id int, name varchar(20))",
+		`CREATE TABLE "my ports" (id int)`,
+		// 读取 broken 的列时会出错
+		"CREATE TABLE gone (id int)",
+		"CREATE VIEW broken AS SELECT * FROM gone",
+		"DROP TABLE gone",
+	} {
+		if _, err := conn.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage := memcore.NewStorage()
+	for _, tags := range [][]KeyValue{
+		{{Key: "mo", Value: "2"}, {Key: "if", Value: "1"}},
+		{{Key: "mo", Value: "1"}},
+	} {
+		table, err := memcore.ToTable([]map[string]interface{}{{"f1": "a"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.Set("cpu", tags, false, time.Now(), table, nil)
+	}
+
+	ctx := &Context{
+		Ctx:     context.Background(),
+		Storage: WrapStorage(storage),
+		Foreign: NewDbForeign("sqlite3", conn),
+	}
+	for _, test := range []struct {
+		sql  string
+		want []string
+	}{
+		{
+			sql:  "show tables",
+			want: []string{`"cpu","storage"`, `"fdw.broken","fdw"`, `"fdw.devices","fdw"`, `"fdw.my ports","fdw"`},
+		},
+		{
+			sql:  "SHOW TAG KEYS FROM cpu",
+			want: []string{`"if"`, `"mo"`},
+		},
+		{
+			sql:  "SHOW TAG VALUES FROM cpu WITH KEY = mo;",
+			want: []string{`"mo","1"`, `"mo","2"`},
+		},
+		{
+			sql:  "describe cpu",
+			want: []string{`"@if","tag"`, `"@mo","tag"`, `"@_time","pseudo"`, `"@_err","pseudo"`, `"@_table","pseudo"`, `"f1","column"`},
+		},
+		{
+			sql:  "desc fdw.devices",
+			want: []string{`"id","column"`, `"name","column"`},
+		},
+		{
+			sql:  "select table_name, column_name from information_schema.columns where kind = 'column' order by table_name, ordinal_position",
+			want: []string{`"cpu","f1"`, `"fdw.devices","id"`, `"fdw.devices","name"`, `"fdw.my ports","id"`},
+		},
+		{
+			sql:  "select column_name from INFORMATION_SCHEMA.COLUMNS where table_name = 'cpu' and kind = 'column'",
+			want: []string{`"f1"`},
+		},
+		{
+			sql:  "select tag_value from information_schema.tags where table_name = 'cpu' and tag_key = 'mo'",
+			want: []string{`"1"`, `"2"`},
+		},
+		{
+			sql:  "select t.source, c.column_name from information_schema.tables as t join information_schema.columns as c on t.table_name = c.table_name where c.kind = 'tag'",
+			want: []string{`"storage","@if"`, `"storage","@mo"`},
+		},
+	} {
+		results, err := Execute(ctx, test.sql)
+		if err != nil {
+			t.Error(test.sql, err)
+			continue
+		}
+		got := RecordToLines(t, results, false)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Error(test.sql, "want", test.want, "got", got)
+		}
+	}
+
+	// 读取出错的表被跳过, table_name 的条件会在读取列之前过滤表
+	ctx.Debuger = ExecuteTracer{}
+	if _, err := Execute(ctx, "select * from information_schema.columns"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ctx.Debuger.Skipped) != 1 || ctx.Debuger.Skipped[0].Name.Table != "fdw.broken" {
+		t.Error("want fdw.broken skipped, got", ctx.Debuger.Skipped)
+	}
+	ctx.Debuger = ExecuteTracer{}
+	if _, err := Execute(ctx, "select * from information_schema.columns where table_name in ('cpu', 'fdw.devices')"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ctx.Debuger.Skipped) != 0 {
+		t.Error("want no table skipped, got", ctx.Debuger.Skipped)
+	}
+
+	for _, sqlstr := range []string{
+		"show tag keys from disk",
+		"select * from information_schema.disks",
+	} {
+		if _, err := Execute(ctx, sqlstr); err == nil {
+			t.Error(sqlstr, "want error for table that isnot exists")
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package memsql
+
+import (
+	"time"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/memsql/memcore"
+)
+
+// DefaultBatchSize 是一次调用 BatchReadFunc 时 tag 集的默认上限
+const DefaultBatchSize = 100
+
+// BatchResult 是 BatchReadFunc 中一个 tag 集的读取结果, 字段的含义同 ReadFunc 的返回值
+type BatchResult struct {
+	Time  time.Time
+	Value interface{}
+	Err   error
+}
+
+// BatchReadFunc 一次读取多个 tag 集对应的运行时数据, 返回的结果与 tagsList 按下标一一对应,
+// 返回 error 时表示整个批次都失败了
+type BatchReadFunc func(ctx *SessionContext, tableName string, tagsList [][]memcore.KeyValue) ([]BatchResult, error)
+
+// readOne 读取一个 tag 集, Read 为 nil 时使用 BatchRead
+func (hs *HookStorage) readOne(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+	if hs.Read != nil {
+		return hs.Read(ctx, tableName, tags)
+	}
+	if hs.BatchRead == nil {
+		return time.Time{}, nil, errors.New("Read or BatchRead is required")
+	}
+
+	results, err := hs.BatchRead(ctx, tableName, [][]memcore.KeyValue{tags})
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	if len(results) == 0 {
+		return time.Time{}, nil, errors.New("batch read of '" + tableName + "' returns no result")
+	}
+	return results[0].Time, results[0].Value, results[0].Err
+}
+
+// batchRead 用一次 BatchRead 调用读取 pending 中下标为 job 的 tag 集, 结果写到 results 中
+//
+// 正在被其它查询读取的 tag 集不会再次读取, 而是等待它的结果
+func (hs *HookStorage) batchRead(ctx *SessionContext, tableName string, pending [][]memcore.KeyValue, job []int, results []readResult) {
+	type owned struct {
+		idx  int
+		key  string
+		call *readCall
+		done bool
+	}
+
+	var waits []int
+	var calls = map[int]*readCall{}
+	var list []*owned
+	now := time.Now()
+	for _, idx := range job {
+		key := readKey(tableName, pending[idx])
+		if err := hs.breakers.allow(hs.Breaker, key, now); err != nil {
+			results[idx].err = err
+			continue
+		}
+		c, owner := hs.reads.claim(key)
+		if !owner {
+			calls[idx] = c
+			waits = append(waits, idx)
+			continue
+		}
+		list = append(list, &owned{idx: idx, key: key, call: c})
+	}
+
+	// BatchRead 发生 panic 时也要结束登记的读取, 否则等待它们的查询会一直阻塞
+	defer func() {
+		for _, o := range list {
+			if !o.done {
+				hs.reads.finish(o.key, o.call, nil, errors.New("batch read of '"+tableName+"' is aborted"))
+			}
+		}
+	}()
+
+	if len(list) > 0 {
+		tagsList := make([][]memcore.KeyValue, len(list))
+		for i, o := range list {
+			tagsList[i] = pending[o.idx]
+		}
+
+		var batch []BatchResult
+		batchErr := hs.withRetry(ctx, tableName, func() error {
+			var err error
+			batch, err = hs.BatchRead(ctx, tableName, tagsList)
+			return err
+		})
+
+		for i, o := range list {
+			var r BatchResult
+			if batchErr != nil {
+				r.Err = batchErr
+			} else if i < len(batch) {
+				r = batch[i]
+			} else {
+				r.Err = errors.New("batch read of '" + tableName + "' returns no result for '" + memcore.KeyValues(tagsList[i]).ToKey() + "'")
+			}
+
+			value, err := hs.save(ctx, o.key, tableName, tagsList[i], r.Time, r.Value, r.Err)
+			results[o.idx].value, results[o.idx].err = value, err
+			o.done = true
+			hs.reads.finish(o.key, o.call, value, err)
+		}
+	}
+
+	for _, idx := range waits {
+		c := calls[idx]
+		c.wg.Wait()
+		results[idx].value, results[idx].err = c.value, c.err
+	}
+}
@@ -0,0 +1,271 @@
+package memsql
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/memsql/memcore"
+	"github.com/xwb1989/sqlparser"
+)
+
+// WatchableStorage 是数据变化时可以发出通知的 Storage, 持续查询依赖它
+type WatchableStorage interface {
+	// Watch 注册一个回调, 每次数据变化后调用它, 不支持时返回错误
+	Watch(fn func(memcore.Change)) (cancel func(), err error)
+}
+
+func (s storageWrapper) Watch(fn func(memcore.Change)) (func(), error) {
+	return watchStorage(s.storage, fn)
+}
+
+// Watch 注册一个回调, 在 Storage 的数据变化后调用它, 包括读取后写入的数据
+func (hs *HookStorage) Watch(fn func(memcore.Change)) (func(), error) {
+	return watchStorage(hs.Storage, fn)
+}
+
+func watchStorage(storage memcore.Storage, fn func(memcore.Change)) (func(), error) {
+	notifier, ok := storage.(memcore.ChangeNotifier)
+	if !ok {
+		return nil, errors.New("storage doesnot support watch, please wrap it with memcore.NewWatchedStorage")
+	}
+	return notifier.Watch(fn), nil
+}
+
+// Update 是持续查询的一次执行结果
+type Update struct {
+	Results RecordSet
+	// Added 和 Removed 是和上一次的结果相比增加和删除的记录, 第一次执行时 Added 是所有的记录
+	Added   []Record
+	Removed []Record
+	// Changes 是触发这次执行的变化, 第一次执行时为 nil
+	Changes []memcore.Change
+	Err     error
+}
+
+// ContinuousQuery 是一个持续查询, 它的源表有变化时重新执行 SQL, 见 Subscribe
+type ContinuousQuery struct {
+	ctx      *Context
+	sqlstr   string
+	tables   map[string]struct{}
+	onUpdate func(Update)
+	cancel   func()
+
+	mu      sync.Mutex
+	pending []memcore.Change
+	notify  chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+
+	last    []Record
+	hasLast bool
+}
+
+// Subscribe 注册一个持续查询, 它先执行一次 sqlstr, 之后每当 sqlstr 的源表被 Set, Delete 或 Clear
+// 修改时重新执行, 结果有变化或出错时调用 onUpdate.
+//
+// 执行期间发生的多次变化会合并为一次执行, onUpdate 在单独的 goroutine 中按顺序调用, 需要 channel
+// 时可以在 onUpdate 中发送. 查询 information_schema 时任何表的变化都会重新执行.
+// ctx.Ctx 结束或调用 Close 后停止
+func Subscribe(ctx *Context, sqlstr string, onUpdate func(Update)) (*ContinuousQuery, error) {
+	watchable, ok := ctx.Storage.(WatchableStorage)
+	if !ok {
+		return nil, errors.New("storage doesnot support watch")
+	}
+
+	rewrited, _, err := rewriteAsOf(sqlstr)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := parse(rewrited)
+	if err != nil {
+		return nil, errors.Wrap(err, "only select statement could be subscribed")
+	}
+
+	cq := &ContinuousQuery{
+		ctx:      ctx,
+		sqlstr:   sqlstr,
+		tables:   sourceTables(stmt),
+		onUpdate: onUpdate,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	cq.cancel, err = watchable.Watch(cq.changed)
+	if err != nil {
+		return nil, err
+	}
+
+	cq.wg.Add(1)
+	go cq.run()
+	return cq, nil
+}
+
+// sourceTables 返回语句中查询的表, 返回 nil 表示依赖所有的表
+func sourceTables(stmt sqlparser.SelectStatement) map[string]struct{} {
+	tables := map[string]struct{}{}
+	all := false
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		expr, ok := node.(*sqlparser.AliasedTableExpr)
+		if !ok {
+			return true, nil
+		}
+		tableName, ok := expr.Expr.(sqlparser.TableName)
+		if !ok {
+			// 子查询
+			return true, nil
+		}
+		qualifier := tableName.Qualifier.String()
+		switch {
+		case strings.EqualFold(qualifier, InformationSchema):
+			all = true
+		case qualifier == "fdw":
+		default:
+			tables[tableName.Name.String()] = struct{}{}
+		}
+		return false, nil
+	}, stmt)
+	if all {
+		return nil
+	}
+	return tables
+}
+
+// Tables 返回持续查询依赖的表, 按名称排列, 依赖所有的表时返回 nil
+func (cq *ContinuousQuery) Tables() []string {
+	if cq.tables == nil {
+		return nil
+	}
+	names := make([]string, 0, len(cq.tables))
+	for name := range cq.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (cq *ContinuousQuery) changed(change memcore.Change) {
+	if cq.tables != nil {
+		if _, ok := cq.tables[change.Table]; !ok {
+			return
+		}
+	}
+
+	cq.mu.Lock()
+	cq.pending = append(cq.pending, change)
+	cq.mu.Unlock()
+
+	select {
+	case cq.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (cq *ContinuousQuery) run() {
+	defer cq.wg.Done()
+
+	var ctxDone <-chan struct{}
+	if cq.ctx.Ctx != nil {
+		ctxDone = cq.ctx.Ctx.Done()
+	}
+
+	cq.execute(nil)
+	for {
+		select {
+		case <-cq.done:
+			return
+		case <-ctxDone:
+			cq.stop()
+			return
+		case <-cq.notify:
+		}
+
+		cq.mu.Lock()
+		changes := cq.pending
+		cq.pending = nil
+		cq.mu.Unlock()
+		if len(changes) > 0 {
+			cq.execute(changes)
+		}
+	}
+}
+
+func (cq *ContinuousQuery) execute(changes []memcore.Change) {
+	ctx := *cq.ctx
+	// 每次执行使用自己的 Debuger, 避免和调用者共享
+	ctx.Debuger = ExecuteTracer{}
+	if ctx.Ctx == nil {
+		ctx.Ctx = context.Background()
+	}
+	results, err := Execute(&ctx, cq.sqlstr)
+	if err != nil {
+		cq.onUpdate(Update{Changes: changes, Err: err})
+		return
+	}
+
+	added, removed := diffRecords(cq.last, results)
+	if cq.hasLast && len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	cq.last = results
+	cq.hasLast = true
+	cq.onUpdate(Update{
+		Results: results,
+		Added:   added,
+		Removed: removed,
+		Changes: changes,
+	})
+}
+
+// diffRecords 比较两次的结果, 返回增加和删除的记录, 相同的记录出现多次时按次数比较
+func diffRecords(old, current []Record) (added, removed []Record) {
+	counts := map[string]int{}
+	for _, r := range old {
+		counts[recordKey(r)]++
+	}
+	for _, r := range current {
+		key := recordKey(r)
+		if counts[key] > 0 {
+			counts[key]--
+			continue
+		}
+		added = append(added, r)
+	}
+	for _, r := range old {
+		key := recordKey(r)
+		if counts[key] > 0 {
+			counts[key]--
+			removed = append(removed, r)
+		}
+	}
+	return added, removed
+}
+
+func recordKey(r Record) string {
+	var sb strings.Builder
+	for idx, column := range r.Columns {
+		if idx > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(column.Name)
+	}
+	sb.WriteString("=")
+	r.ToLine(&sb, ",")
+	return sb.String()
+}
+
+func (cq *ContinuousQuery) stop() {
+	cq.once.Do(func() {
+		cq.cancel()
+		close(cq.done)
+	})
+}
+
+// Close 停止持续查询, 并等待正在执行的 onUpdate 返回, 不能在 onUpdate 中调用
+func (cq *ContinuousQuery) Close() error {
+	cq.stop()
+	cq.wg.Wait()
+	return nil
+}
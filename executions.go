@@ -6,6 +6,7 @@ import (
 	"io"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/runner-mei/errors"
 	"github.com/runner-mei/memsql/memcore"
@@ -47,7 +48,34 @@ type storageWrapper struct {
 }
 
 func (s storageWrapper) From(ctx *SessionContext, tableName TableAlias, tableExpr sqlparser.Expr, trace func(name TableName)) (memcore.Query, error) {
-	return fromRun(ctx, s.storage, tableName, tableExpr, trace)
+	return s.FromVersions(ctx, tableName, tableExpr, memcore.History{}, trace)
+}
+
+func (s storageWrapper) FromVersions(ctx *SessionContext, tableName TableAlias, tableExpr sqlparser.Expr, history memcore.History, trace func(name TableName)) (memcore.Query, error) {
+	var tagsList [][]memcore.KeyValue
+	ctx.OnIniting(func() error {
+		var err error
+		tagsList, err = toTagsList(ctx, tableName, tableExpr)
+		return err
+	})
+	return memcore.Query{
+		Iterate: func() memcore.Iterator {
+			q, err := fromRun(ctx, s.storage, tableName, tableExpr, tagsList, history, trace)
+			if err != nil {
+				return func(ctx memcore.Context) (Record, error) {
+					return memcore.Record{}, err
+				}
+			}
+			return q.Iterate()
+		},
+		Batches: func() ([]memcore.Batch, error) {
+			q, err := fromRun(ctx, s.storage, tableName, tableExpr, tagsList, history, trace)
+			if err != nil {
+				return nil, err
+			}
+			return q.ReadBatches()
+		},
+	}, nil
 }
 
 
@@ -124,7 +152,35 @@ func toGetValuer(tags memcore.KeyValues) vm.GetValuer {
 	})
 }
 
-func fromRun(ctx *SessionContext, storage memcore.Storage, tableName TableAlias, tableExpr sqlparser.Expr, trace func(name TableName)) (memcore.Query, error) {
+// fromRun 从 storage 中查询表, tagsList 是事先从 tableExpr 中取出的 tag 集, 为 nil 时只用过滤函数
+func fromRun(ctx *SessionContext, storage memcore.Storage, tableName TableAlias, tableExpr sqlparser.Expr, tagsList [][]memcore.KeyValue, history memcore.History, trace func(name TableName)) (memcore.Query, error) {
+	f, err := toTagFilter(ctx, tableName, tableExpr)
+	if err != nil {
+		return memcore.Query{}, err
+	}
+	return memcore.FromStorageByTags(storage, tableName.Name, tagsList, f, memcore.FromOptions{
+		Trace:   trace,
+		OnError: ctx.OnError,
+		Skipped: ctx.Debuger.SkipMeasurement,
+		History: history,
+	})
+}
+
+// toTagsList 从 tableExpr 中取出 tag 的等值条件, 用于在 storage 中通过索引查找,
+// 取不出来时返回 nil, 这时只用过滤函数. 它会执行条件中的子查询, 只应在初始化时调用一次
+func toTagsList(ctx *SessionContext, tableName TableAlias, tableExpr sqlparser.Expr) ([][]memcore.KeyValue, error) {
+	if tableExpr == nil {
+		return nil, nil
+	}
+	kvs, err := parser.ToKeyValues(ctx, tableExpr, tableName, nil)
+	if err != nil || kvs == nil {
+		return nil, err
+	}
+	return parser.ToKeyValueArray(nil, kvs)
+}
+
+// toTagFilter 将 tableExpr 中与 tableName 的 tag 有关的条件转换为对 TableName 的过滤函数
+func toTagFilter(ctx *SessionContext, tableName TableAlias, tableExpr sqlparser.Expr) (func(name memcore.TableName) (bool, error), error) {
 	var f = func(name memcore.TableName) (bool, error) {
 		return true, nil
 	}
@@ -132,18 +188,17 @@ func fromRun(ctx *SessionContext, storage memcore.Storage, tableName TableAlias,
 	if tableExpr != nil {
 		_, expr, err := parser.SplitBy(tableExpr, parser.ByTableTag(tableName))
 		if err != nil {
-			return memcore.Query{},  errors.Wrap(err, "couldn't resolve where '"+sqlparser.String(expr)+"'")
+			return nil,  errors.Wrap(err, "couldn't resolve where '"+sqlparser.String(expr)+"'")
 		}
 		ff, err := parser.ToFilter(ctx, expr)
 		if err != nil {
-			return memcore.Query{},  errors.Wrap(err, "couldn't convert tableExpr '"+sqlparser.String(tableExpr)+"'")
+			return nil,  errors.Wrap(err, "couldn't convert tableExpr '"+sqlparser.String(tableExpr)+"'")
 		}
 		f = func(name memcore.TableName) (bool, error) {
 			return ff(toGetValuer(name.Tags))
 		}
 	}
-
-	return memcore.FromStorage(storage, tableName.Name, f, trace)
+	return f, nil
 }
 
 type Context struct {
@@ -151,6 +206,13 @@ type Context struct {
 	Debuger ExecuteTracer
 	Storage Storage
 	Foreign Foreign
+
+	// Freshness 覆盖本次查询中 HookStorage 的数据有效期
+	Freshness *Freshness
+
+	// OnError 决定查询遇到读取出错的 measurement 时怎么处理, 默认返回错误,
+	// 跳过的 measurement 会记录在 Debuger.Skipped 中
+	OnError memcore.ErrorPolicy
 }
 
 type SessionContext struct {
@@ -161,6 +223,7 @@ type SessionContext struct {
 	alias      map[string]string
 	resultSets map[string][]memcore.Record
 	queries    []TableQuery
+	asOf       map[string]time.Time
 }
 
 type TableQuery struct {
@@ -262,6 +325,14 @@ type TableContext struct {
 
 
 func Execute(ctx *Context, sqlstmt string) (rset RecordSet, err error) {
+	if results, ok, e := executeMetadata(&SessionContext{Context: ctx}, sqlstmt); ok {
+		return results, e
+	}
+
+	sqlstmt, asOf, e := rewriteAsOf(sqlstmt)
+	if e != nil {
+		return nil, e
+	}
 	stmt, e := parse(sqlstmt)
 	if e != nil {
 		return nil, e
@@ -270,6 +341,7 @@ func Execute(ctx *Context, sqlstmt string) (rset RecordSet, err error) {
 		Context: ctx,
 		alias:   map[string]string{},
 		resultSets: map[string][]memcore.Record{},
+		asOf:    asOf,
 	}
 	defer func() {
 		if e := sessctx.Close(); e != nil {
@@ -386,10 +458,17 @@ func ExecuteSelect(ec *SessionContext, stmt *sqlparser.Select, hasJoin bool) (me
 		hasJoin = true
 	}
 
-	_, query, err := ExecuteTableExpression(ec, stmt.From[0], stmt.Where, hasJoin)
+	ds, query, err := ExecuteTableExpression(ec, stmt.From[0], stmt.Where, hasJoin)
 	if err != nil {
 		return memcore.Query{}, errors.Wrap(err, "couldn't parse from expression")
 	}
+	if _, ok := stmt.From[0].(*sqlparser.AliasedTableExpr); ok && !hasJoin {
+		if schema := tableSchemaOf(ec, ds); schema != nil {
+			if err := validateSelectExprs(schema, ds, stmt.SelectExprs); err != nil {
+				return memcore.Query{}, err
+			}
+		}
+	}
 
 	if len(stmt.From) > 1 {
 		for idx := 1; idx < len(stmt.From); idx ++ {
@@ -407,7 +486,10 @@ func ExecuteSelect(ec *SessionContext, stmt *sqlparser.Select, hasJoin bool) (me
 		// 	fmt.Println(r.GoString())
 		// 	return r, nil
 		// })
+	}
 
+	// 有 join 时每个表只用 where 中它自己的条件过滤, 跨表的条件要在 join 之后再过滤一次
+	if _, isJoin := stmt.From[0].(*sqlparser.JoinTableExpr); (isJoin || len(stmt.From) > 1) && stmt.Where != nil {
 		query, err = ExecuteWhere(ec, query, stmt.Where.Expr)
 		if err != nil {
 			return memcore.Query{}, err
@@ -416,6 +498,15 @@ func ExecuteSelect(ec *SessionContext, stmt *sqlparser.Select, hasJoin bool) (me
 
 	query = ec.Debuger.Track(query)
 
+	// 只是对一个表的 count, sum 和 avg 时按列计算
+	if names, aggregates, ok := toBatchAggregates(stmt); ok && query.Batches != nil {
+		rowQuery, err := ExecuteSelectExprs(ec, query, stmt.SelectExprs)
+		if err != nil {
+			return memcore.Query{}, err
+		}
+		return executeBatchAggregates(query, rowQuery, names, aggregates), nil
+	}
+
 	if stmt.GroupBy != nil {
 		query, err = ExecuteGroupBy(ec, query, stmt.GroupBy)
 		if err != nil {
@@ -628,6 +719,9 @@ func ExecuteAliasedTableExpression(ec *SessionContext, expr *sqlparser.AliasedTa
 }
 
 func ExecuteTable(ec *SessionContext, ds Datasource, where *sqlparser.Where, hasJoin bool) (memcore.Query, error) {
+	if strings.EqualFold(ds.Qualifier, InformationSchema) {
+		return executeInformationSchema(ec, ds, where, hasJoin)
+	}
 	if ds.Qualifier == "fdw" {
 		tableAlias := TableAlias{Name: strings.TrimPrefix(ds.Table, "fdw."), Alias: ds.As}
 		if where == nil || !hasJoin {
@@ -648,10 +742,31 @@ func ExecuteTable(ec *SessionContext, ds Datasource, where *sqlparser.Where, has
 		expr = where.Expr
 	}
 
+	history, err := ec.historyOf(ds)
+	if err != nil {
+		return memcore.Query{}, err
+	}
+
+	if schema := tableSchemaOf(ec, ds); schema != nil && expr != nil {
+		if err := validateWhere(ec, schema, ds, expr, hasJoin); err != nil {
+			return memcore.Query{}, errors.Wrap(err, "couldn't convert where '"+sqlparser.String(expr)+"'")
+		}
+	}
+
 	var tableNames []TableName
-	query, err := ec.Storage.From(ec, tableAlias, expr, func(name TableName){
+	var query memcore.Query
+	trace := func(name TableName){
 		tableNames = append(tableNames, name)
-	})
+	}
+	if history.IsZero() {
+		query, err = ec.Storage.From(ec, tableAlias, expr, trace)
+	} else {
+		versioned, ok := ec.Storage.(VersionedStorage)
+		if !ok {
+			return memcore.Query{}, errors.New("storage of table '" + ds.Table + "' doesnot support history")
+		}
+		query, err = versioned.FromVersions(ec, tableAlias, expr, history, trace)
+	}
 	if err != nil {
 		return memcore.Query{}, err
 	}
@@ -676,10 +791,9 @@ func ExecuteTable(ec *SessionContext, ds Datasource, where *sqlparser.Where, has
 	}
 
 	if ds.As != "" {
-		query = query.Map(RenameTableToAlias(ds.As))
+		query = query.MapBatches(RenameTableToAlias(ds.As), renameBatchToAlias(ds.As))
 	}
 
-
 	if debuger != nil {
 		return debuger.Track(query), nil
 	}
@@ -695,9 +809,14 @@ func ExecuteWhere(ec *SessionContext, query memcore.Query, expr sqlparser.Expr)
 	if err != nil {
 		return memcore.Query{}, errors.Wrap(err, "couldn't convert where '"+sqlparser.String(expr)+"'")
 	}
-	query = query.Where(func(idx int, r memcore.Record) (bool, error) {
+	predicate := func(idx int, r memcore.Record) (bool, error) {
 		return f(ToRecordValuer(&r, true))
-	})
+	}
+	if selector, ok := toBatchSelector(ec, expr); ok {
+		query = query.WhereBatches(predicate, selector.selectRows)
+	} else {
+		query = query.Where(predicate)
+	}
 
 	// type Where Expr
 	return query, nil
@@ -827,7 +946,7 @@ func ExecuteSelectExprs(ec *SessionContext, query memcore.Query, selectExprs sql
 			return query, fmt.Errorf("invalid expression %T %+v", subexpr, subexpr)
 		case *sqlparser.AliasedExpr:
 			if subexpr, ok := v.Expr.(*sqlparser.FuncExpr); ok {
-				aggFunc, ok := vm.AggFuncs[subexpr.Name.String()]
+				aggFunc, ok := vm.AggFuncs[subexpr.Name.Lowered()]
 				if ok {
 					if len(subexpr.Exprs) == 0 {
 						return query, fmt.Errorf("invalid expression %T %+v", subexpr, subexpr)
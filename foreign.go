@@ -183,6 +183,7 @@ func RenameTableToAlias(alias string) func(memcore.Context, memcore.Record) (mem
 			Tags:    r.Tags,
 			Columns: columns,
 			Values:  r.Values,
+			Meta:    r.Meta,
 		}, nil
 	}
 }
@@ -0,0 +1,66 @@
+package memsql
+
+import (
+	"time"
+
+	"github.com/runner-mei/memsql/memcore"
+)
+
+// Freshness 是 HookStorage 中缓存数据的有效期
+//
+// 字段为 0 时使用上一级的配置, 小于 0 时表示不缓存
+type Freshness struct {
+	// TTL 是读取成功后数据的有效期
+	TTL time.Duration
+
+	// ErrorTTL 是读取失败后不再重试的时间
+	ErrorTTL time.Duration
+
+	// MaxStale 大于 0 时, 超过 TTL 但没有超过 TTL + MaxStale 的数据会被直接使用,
+	// 同时在后台重新读取
+	MaxStale time.Duration
+}
+
+// DefaultFreshness 是没有任何配置时使用的有效期
+var DefaultFreshness = Freshness{
+	TTL:      1 * time.Minute,
+	ErrorTTL: 10 * time.Second,
+}
+
+func (f Freshness) merge(parent Freshness) Freshness {
+	if f.TTL == 0 {
+		f.TTL = parent.TTL
+	}
+	if f.ErrorTTL == 0 {
+		f.ErrorTTL = parent.ErrorTTL
+	}
+	if f.MaxStale == 0 {
+		f.MaxStale = parent.MaxStale
+	}
+	return f
+}
+
+func (f Freshness) limits(now time.Time) (time.Time, time.Time) {
+	return now.Add(-f.TTL), now.Add(-f.ErrorTTL)
+}
+
+// FreshnessPolicy 按表名和 tag 集决定数据的有效期, 优先级从高到低依次为
+// ByTags, Tables 和 Default
+type FreshnessPolicy struct {
+	Default Freshness
+	Tables  map[string]Freshness
+	ByTags  func(tableName string, tags []memcore.KeyValue) (Freshness, bool)
+}
+
+func (p *FreshnessPolicy) Get(tableName string, tags []memcore.KeyValue) Freshness {
+	f := p.Default.merge(DefaultFreshness)
+	if table, ok := p.Tables[tableName]; ok {
+		f = table.merge(f)
+	}
+	if p.ByTags != nil {
+		if byTags, ok := p.ByTags(tableName, tags); ok {
+			f = byTags.merge(f)
+		}
+	}
+	return f
+}
@@ -0,0 +1,133 @@
+package memsql
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/memsql/memcore"
+	"github.com/runner-mei/memsql/vm"
+	"github.com/xwb1989/sqlparser"
+)
+
+// VersionedStorage 是可以查询历史版本的 Storage
+//
+// 查询 history.cpu 时返回 cpu 保留的所有版本, 可以用 @_time 过滤, 查询
+// cpu AS OF '2026-10-01 10:00:00' 时返回每个 tag 集在这个时间点的版本
+type VersionedStorage interface {
+	Storage
+
+	FromVersions(ctx *SessionContext, tableName TableAlias, tableExpr sqlparser.Expr, history memcore.History, trace func(TableName)) (memcore.Query, error)
+}
+
+// HistoryQualifier 是查询所有历史版本时表名的前缀, 同 information_schema 和 fdw 一样是保留的
+const HistoryQualifier = "history"
+
+// asOfQualifier 是 AS OF 改写后表名的前缀, 后面跟着序号, 它是保留的, 不能直接在 SQL 中使用
+const asOfQualifier = "asof_"
+
+// sqlToken 是 SQL 中的一个 token, start 和 end 是它在 SQL 中的位置
+type sqlToken struct {
+	typ        int
+	val        string
+	start, end int
+}
+
+// scanTokens 用 sqlparser 的 Tokenizer 切分 sqlstr, 跳过注释, 遇到错误时停止, 错误由解析时报告
+func scanTokens(sqlstr string) []sqlToken {
+	var tokens []sqlToken
+	tokenizer := sqlparser.NewStringTokenizer(sqlstr)
+	offset := 0
+	for {
+		typ, val := tokenizer.Scan()
+		if typ == 0 || typ == sqlparser.LEX_ERROR {
+			return tokens
+		}
+		// Tokenizer 会预读一个字符, 所以 token 结束于 Position-1
+		end := tokenizer.Position - 1
+		if end > len(sqlstr) {
+			end = len(sqlstr)
+		}
+		start := offset
+		for start < end && strings.IndexByte(" \t\r\n", sqlstr[start]) >= 0 {
+			start++
+		}
+		offset = end
+		if typ == sqlparser.COMMENT {
+			continue
+		}
+		tokens = append(tokens, sqlToken{typ: typ, val: string(val), start: start, end: end})
+	}
+}
+
+// rewriteAsOf 将 sqlparser 不支持的 "cpu AS OF '2026-10-01 10:00:00'" 改写为 "asof_1.cpu",
+// 并返回每个前缀对应的时间. 改写是按 token 进行的, 字符串和注释中的内容不会被改写,
+// 带前缀的表(如 fdw.cpu)没有历史版本, 对它们使用 AS OF 时返回错误
+func rewriteAsOf(sqlstr string) (string, map[string]time.Time, error) {
+	tokens := scanTokens(sqlstr)
+
+	var asOf map[string]time.Time
+	var sb strings.Builder
+	last := 0
+	for idx, token := range tokens {
+		if token.typ != sqlparser.ID {
+			continue
+		}
+		if idx+1 < len(tokens) && tokens[idx+1].typ == '.' &&
+			strings.HasPrefix(strings.ToLower(token.val), asOfQualifier) {
+			return "", nil, errors.New("table qualifier '" + token.val + "' is reserved")
+		}
+		if idx+3 >= len(tokens) ||
+			tokens[idx+1].typ != sqlparser.AS ||
+			tokens[idx+2].typ != sqlparser.ID || strings.ToLower(tokens[idx+2].val) != "of" ||
+			tokens[idx+3].typ != sqlparser.STRING {
+			continue
+		}
+		if idx >= 2 && tokens[idx-1].typ == '.' {
+			return "", nil, errors.New("AS OF isnot supported on table '" + tokens[idx-2].val + "." + token.val + "', only tables in storage have history")
+		}
+
+		literal := tokens[idx+3]
+		t, err := vm.ToDatetime(literal.val)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "invalid AS OF time '"+literal.val+"'")
+		}
+		if asOf == nil {
+			asOf = map[string]time.Time{}
+		}
+		qualifier := asOfQualifier + strconv.Itoa(len(asOf)+1)
+		asOf[qualifier] = t
+
+		sb.WriteString(sqlstr[last:token.start])
+		sb.WriteString(qualifier)
+		sb.WriteString(".")
+		sb.WriteString(sqlstr[token.start:token.end])
+		last = literal.end
+	}
+	if asOf == nil {
+		return sqlstr, nil, nil
+	}
+	sb.WriteString(sqlstr[last:])
+	return sb.String(), asOf, nil
+}
+
+// historyOf 返回表要查询的历史版本
+func (sc *SessionContext) historyOf(ds Datasource) (memcore.History, error) {
+	if ds.Qualifier == HistoryQualifier {
+		return memcore.History{All: true}, nil
+	}
+	if strings.HasPrefix(ds.Qualifier, asOfQualifier) {
+		t, ok := sc.asOf[ds.Qualifier]
+		if !ok {
+			return memcore.History{}, errors.New("table qualifier '" + ds.Qualifier + "' is unknown")
+		}
+		return memcore.History{AsOf: t}, nil
+	}
+	return memcore.History{}, nil
+}
+
+// FromVersions 查询 Storage 中保留的历史版本, 它不会调用 Read
+func (hs *HookStorage) FromVersions(ctx *SessionContext, tableName TableAlias, tableExpr sqlparser.Expr, history memcore.History, trace func(TableName)) (memcore.Query, error) {
+	return storageWrapper{storage: hs.Storage}.FromVersions(ctx, tableName, tableExpr, history, trace)
+}
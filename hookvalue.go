@@ -0,0 +1,271 @@
+package memsql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/memsql/memcore"
+	"github.com/runner-mei/memsql/vm"
+)
+
+// ToHookTable 将 ReadFunc 返回的值转换为 memcore.Table, 支持的类型有
+//
+//   - memcore.Table 或 *memcore.Table
+//   - map[string]interface{} 或 []map[string]interface{}
+//   - 结构体, 结构体的指针, 以及它们的 slice, 列名优先使用字段的 memsql tag, 其次是 json tag
+//   - json.RawMessage, 其内容是一个对象或对象的数组
+//
+// 值只有一行时 isSingleValue 为 true
+func ToHookTable(value interface{}) (table memcore.Table, isSingleValue bool, err error) {
+	switch v := value.(type) {
+	case nil:
+		return memcore.Table{}, false, errors.New("value is nil")
+	case memcore.Table:
+		return v, false, nil
+	case *memcore.Table:
+		if v == nil {
+			return memcore.Table{}, false, errors.New("value is nil")
+		}
+		return *v, false, nil
+	case map[string]interface{}:
+		table, err = memcore.ToTable([]map[string]interface{}{v})
+		return table, true, err
+	case []map[string]interface{}:
+		table, err = memcore.ToTable(v)
+		return table, false, err
+	case json.RawMessage:
+		return jsonToTable(v)
+	}
+
+	rv := reflect.ValueOf(value)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return memcore.Table{}, false, errors.New("value is nil")
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		fields := structFields(rv.Type())
+		table = memcore.Table{Columns: fields.columns()}
+		record, err := fields.values(rv)
+		if err != nil {
+			return memcore.Table{}, false, err
+		}
+		table.Records = append(table.Records, record)
+		return table, true, nil
+	case reflect.Map:
+		record, err := mapToRecord(rv)
+		if err != nil {
+			return memcore.Table{}, false, err
+		}
+		table, err = memcore.ToTable([]map[string]interface{}{record})
+		return table, true, err
+	case reflect.Slice, reflect.Array:
+		table, err = sliceToTable(rv)
+		return table, false, err
+	}
+	return memcore.Table{}, false, errors.New("unknown type - " + rv.Type().String())
+}
+
+func jsonToTable(bs json.RawMessage) (memcore.Table, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(bs))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return memcore.Table{}, false, errors.Wrap(err, "unmarshal json fail")
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		table, err := memcore.ToTable([]map[string]interface{}{jsonRecord(v)})
+		return table, true, err
+	case []interface{}:
+		records := make([]map[string]interface{}, 0, len(v))
+		for idx, elem := range v {
+			record, ok := elem.(map[string]interface{})
+			if !ok {
+				return memcore.Table{}, false, errors.New("json element with index is '" + fmt.Sprint(idx) + "' isnot a object")
+			}
+			records = append(records, jsonRecord(record))
+		}
+		table, err := memcore.ToTable(records)
+		return table, false, err
+	case nil:
+		return memcore.Table{}, false, errors.New("value is null")
+	default:
+		return memcore.Table{}, false, errors.New("json value isnot a object or array")
+	}
+}
+
+// jsonRecord 将 json.Number 转换为 int64 或 float64
+func jsonRecord(record map[string]interface{}) map[string]interface{} {
+	for key, value := range record {
+		number, ok := value.(json.Number)
+		if !ok {
+			continue
+		}
+		if i64, err := number.Int64(); err == nil {
+			record[key] = i64
+		} else if f64, err := number.Float64(); err == nil {
+			record[key] = f64
+		} else {
+			record[key] = number.String()
+		}
+	}
+	return record
+}
+
+func mapToRecord(rv reflect.Value) (map[string]interface{}, error) {
+	if rv.Type().Key().Kind() != reflect.String {
+		return nil, errors.New("unknown type - " + rv.Type().String())
+	}
+	record := map[string]interface{}{}
+	iter := rv.MapRange()
+	for iter.Next() {
+		record[iter.Key().String()] = iter.Value().Interface()
+	}
+	return record, nil
+}
+
+func sliceToTable(rv reflect.Value) (memcore.Table, error) {
+	elemType := rv.Type().Elem()
+	for elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+
+	switch elemType.Kind() {
+	case reflect.Struct:
+		fields := structFields(elemType)
+		table := memcore.Table{Columns: fields.columns()}
+		for i := 0; i < rv.Len(); i++ {
+			elem := reflect.Indirect(rv.Index(i))
+			if !elem.IsValid() {
+				continue
+			}
+			record, err := fields.values(elem)
+			if err != nil {
+				return memcore.Table{}, errors.Wrap(err, "value with index is '"+fmt.Sprint(i)+"' is invalid")
+			}
+			table.Records = append(table.Records, record)
+		}
+		return table, nil
+	case reflect.Map, reflect.Interface:
+		records := make([]map[string]interface{}, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			elem := rv.Index(i)
+			for elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Interface {
+				elem = elem.Elem()
+			}
+			if elem.Kind() != reflect.Map {
+				return memcore.Table{}, errors.New("value with index is '" + fmt.Sprint(i) + "' isnot a map")
+			}
+			record, err := mapToRecord(elem)
+			if err != nil {
+				return memcore.Table{}, err
+			}
+			records = append(records, record)
+		}
+		return memcore.ToTable(records)
+	}
+	return memcore.Table{}, errors.New("unknown type - " + rv.Type().String())
+}
+
+type structField struct {
+	name  string
+	index []int
+}
+
+type structFieldList []structField
+
+func (fields structFieldList) columns() []memcore.Column {
+	columns := make([]memcore.Column, len(fields))
+	for idx := range fields {
+		columns[idx] = memcore.Column{Name: fields[idx].name}
+	}
+	return columns
+}
+
+func (fields structFieldList) values(rv reflect.Value) ([]memcore.Value, error) {
+	record := make([]memcore.Value, len(fields))
+	for idx := range fields {
+		var value interface{}
+		if fv, ok := fieldByIndex(rv, fields[idx].index); ok {
+			value = fv.Interface()
+		}
+		v, err := vm.ToValue(value)
+		if err != nil {
+			return nil, errors.Wrap(err, "value '"+fmt.Sprint(value)+"' of column '"+fields[idx].name+"' is invalid")
+		}
+		record[idx] = v
+	}
+	return record, nil
+}
+
+// fieldByIndex 同 reflect.Value.FieldByIndex, 但嵌入的指针为 nil 时返回 false
+func fieldByIndex(rv reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return reflect.Value{}, false
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return reflect.Value{}, false
+		}
+		rv = rv.Elem()
+	}
+	return rv, true
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// structFields 返回结构体的列, 嵌入的结构体没有指定列名时它的字段会被展开
+func structFields(typ reflect.Type) structFieldList {
+	var fields structFieldList
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+
+		name, ok := field.Tag.Lookup("memsql")
+		if !ok {
+			name, ok = field.Tag.Lookup("json")
+		}
+		if idx := strings.IndexByte(name, ','); idx >= 0 {
+			name = name[:idx]
+		}
+		if name == "-" {
+			continue
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct && fieldType != timeType {
+			for _, sub := range structFields(fieldType) {
+				sub.index = append([]int{i}, sub.index...)
+				fields = append(fields, sub)
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, structField{name: name, index: []int{i}})
+	}
+	return fields
+}
@@ -1,7 +1,8 @@
 package memsql
 
 import (
-	"reflect"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/runner-mei/errors"
@@ -11,14 +12,21 @@ import (
 	// "github.com/cabify/timex"
 )
 
+// ReadFunc 读取一个 tag 集对应的运行时数据, 它会被多个 goroutine 同时调用,
+// 返回值支持的类型见 ToHookTable
 type ReadFunc func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error)
 
+// ListTagsFunc 列出一个表的所有 tag 集
+type ListTagsFunc func(ctx *SessionContext, tableName string) ([][]memcore.KeyValue, error)
+
+// DefaultReadConcurrency 是单个查询中同时调用 ReadFunc 的默认上限
+const DefaultReadConcurrency = 8
 
 func NewHookStorage(storage memcore.Storage, read ReadFunc) *HookStorage {
 	return &HookStorage{
-		Storage:storage, 
-	 	Read: read,
-	 }
+		Storage: storage,
+		Read:    read,
+	}
 }
 
 var _ Storage = &HookStorage{}
@@ -26,26 +34,77 @@ var _ Storage = &HookStorage{}
 type HookStorage struct {
 	Storage memcore.Storage
 
- 	Read ReadFunc
+	Read ReadFunc
+
+	// ReadConcurrency 是单个查询中同时调用 Read 的上限,
+	// 为 0 时使用 DefaultReadConcurrency, 为 1 时顺序读取
+	ReadConcurrency int
+
+	// Freshness 决定已读取的数据在多长时间内不需要重新读取
+	Freshness FreshnessPolicy
+
+	// HotThreshold 是 tag 集在一个刷新周期内被查询多少次后会被后台主动刷新,
+	// 为 0 时表示 1 次, 只有调用 Start 后才会生效
+	HotThreshold int
+
+	// ListTags 不为 nil 时, 查询条件中没有指定 tag 值的查询会读取它返回的所有 tag 集
+	ListTags ListTagsFunc
+
+	// BatchRead 不为 nil 时优先使用它一次读取多个 tag 集, 每次最多 BatchSize 个,
+	// BatchSize 为 0 时使用 DefaultBatchSize
+	BatchRead BatchReadFunc
+	BatchSize int
+
+	// Retry 是 Read 失败后的重试策略
+	Retry RetryPolicy
+
+	// Schemas 是表的列定义, 读取的数据按它排列列并转换值的类型, 没有定义的表按列名排序
+	Schemas map[string]*memcore.Schema
+
+	// Breaker 是 tag 集连续读取失败后的熔断策略
+	Breaker BreakerPolicy
+
+	reads    readGroup
+	refresh  refresher
+	breakers breakers
 }
 
 func (hs *HookStorage) From(ctx *SessionContext, tableName TableAlias, tableExpr sqlparser.Expr, trace func(TableName)) (memcore.Query, error) {
+	// tagsList 是初始化时读取的 tag 集, 查询时直接用它在 storage 中查找
+	var tagsList [][]memcore.KeyValue
 	ctx.OnIniting(func() error {
 		kvs, err := parser.ToKeyValues(ctx, tableExpr, tableName, nil)
 		if err != nil {
-			return   err
+			return err
+		}
+		if kvs == nil {
+			if hs.ListTags == nil {
+				if tableExpr != nil {
+					// 有 tag 条件但不能从中得到 tag 值时报错, 否则用户只能看到表不存在
+					_, tagExpr, err := parser.SplitBy(tableExpr, parser.ByTableTag(tableName))
+					if err == nil && tagExpr != nil {
+						return errors.New("couldn't enumerate tags of '" + tableName.Name + "' from where '" + sqlparser.String(tagExpr) + "', ListTags is required")
+					}
+				}
+				return nil
+			}
+
+			kvs, err = hs.listTags(ctx, tableName, tableExpr)
+			if err != nil {
+				return err
+			}
 		}
 
-		err = hs.EnsureTables(ctx, tableName, kvs)
+		tagsList, err = hs.ensureTables(ctx, tableName, kvs)
 		if err != nil {
-			return  err
+			return err
 		}
 		return nil
 	})
 
 	return memcore.Query{
 		Iterate: func() memcore.Iterator {
-			q, err := fromRun(ctx, hs.Storage, tableName, tableExpr, trace)
+			q, err := fromRun(ctx, hs.Storage, tableName, tableExpr, tagsList, memcore.History{}, trace)
 			if err != nil {
 				return func(ctx memcore.Context) (Record, error) {
 					return memcore.Record{}, err
@@ -53,73 +112,348 @@ func (hs *HookStorage) From(ctx *SessionContext, tableName TableAlias, tableExpr
 			}
 			return q.Iterate()
 		},
+		Batches: func() ([]memcore.Batch, error) {
+			q, err := fromRun(ctx, hs.Storage, tableName, tableExpr, tagsList, memcore.History{}, trace)
+			if err != nil {
+				return nil, err
+			}
+			return q.ReadBatches()
+		},
 	}, nil
 }
 
+type readResult struct {
+	value interface{}
+	err   error
+}
+
+// listTags 用 ListTags 列出表的所有 tag 集, 并用查询中的 tag 条件过滤它们
+func (hs *HookStorage) listTags(ctx *SessionContext, tableName TableAlias, tableExpr sqlparser.Expr) (parser.KeyValueIterator, error) {
+	list, err := hs.ListTags(ctx, tableName.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "list tags of '"+tableName.Name+"' fail")
+	}
+
+	f, err := toTagFilter(ctx, tableName, tableExpr)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched [][]memcore.KeyValue
+	for _, tags := range list {
+		ok, err := f(memcore.TableName{Table: tableName.Name, Tags: tags})
+		if err != nil {
+			// 缺少条件中的 tag 的 tag 集不满足条件, 同 storage.fromTags
+			if errors.Is(err, memcore.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, tags)
+		}
+	}
+	return parser.KeyValueList(matched), nil
+}
+
 func (hs *HookStorage) EnsureTables(ctx *SessionContext, tableName TableAlias, iterator parser.KeyValueIterator) error {
+	_, err := hs.ensureTables(ctx, tableName, iterator)
+	return err
+}
+
+// ensureTables 同 EnsureTables, 并返回 iterator 中所有的 tag 集, 包括不需要读取的
+func (hs *HookStorage) ensureTables(ctx *SessionContext, tableName TableAlias, iterator parser.KeyValueIterator) ([][]memcore.KeyValue, error) {
 	if iterator == nil {
-		return nil
+		return nil, nil
 	}
-	predateLimit := hs.GetPredateLimit(ctx)
+	var all, pending [][]memcore.KeyValue
 	for {
 		tags, err := iterator.Next(nil)
 		if err != nil {
 			if memcore.IsNoRows(err) {
-				return nil
+				break
 			}
-			return err
+			return nil, err
 		}
+		all = append(all, tags)
+
+		hs.refresh.hit(tableName.Name, tags)
 
-		if hs.Storage.Exists(tableName.Name, tags, predateLimit) {
+		freshness := hs.GetFreshness(ctx, tableName.Name, tags)
+		predateLimit, errPredateLimit := freshness.limits(time.Now())
+		if hs.Storage.Exists(tableName.Name, tags, predateLimit, errPredateLimit) {
 			ctx.Debuger.ReadSkip(tableName.Name, tags)
 			continue
 		}
+		if freshness.MaxStale > 0 &&
+			hs.Storage.Exists(tableName.Name, tags, predateLimit.Add(-freshness.MaxStale), errPredateLimit) {
+			ctx.Debuger.ReadStale(tableName.Name, tags)
+			hs.refreshInBackground(tableName.Name, tags)
+			continue
+		}
+		pending = append(pending, tags)
+	}
+	if len(pending) == 0 {
+		return all, nil
+	}
 
-		t, value, err := hs.Read(ctx, tableName.Name, tags)
-		if err != nil {
-			ctx.Debuger.ReadError(tableName.Name, tags, err)
-			hs.Storage.Set(tableName.Name, tags, t, memcore.Table{}, err)
-			return err
+	results := make([]readResult, len(pending))
+	hs.readAll(ctx, tableName.Name, pending, results)
+
+	// 在当前 goroutine 中按顺序报告结果, 这样 Debuger 不需要加锁, 输出也是稳定的
+	var firstErr error
+	for idx, tags := range pending {
+		if results[idx].err != nil {
+			var openErr *CircuitOpenError
+			if errors.As(results[idx].err, &openErr) {
+				ctx.Debuger.ReadRejected(tableName.Name, tags, openErr)
+			} else {
+				ctx.Debuger.ReadError(tableName.Name, tags, results[idx].err)
+			}
+			if firstErr == nil {
+				firstErr = results[idx].err
+			}
+			continue
 		}
+		ctx.Debuger.ReadOk(tableName.Name, tags, results[idx].value)
+	}
+	if ctx.OnError != memcore.ErrorFail {
+		// 出错的 tag 集已经保存在 Storage 中了, 查询时再按 OnError 处理
+		return all, nil
+	}
+	return all, firstErr
+}
 
-		ctx.Debuger.ReadOk(tableName.Name, tags, value)
+func (hs *HookStorage) readAll(ctx *SessionContext, tableName string, pending [][]memcore.KeyValue, results []readResult) {
+	var jobs [][]int
+	if hs.BatchRead != nil {
+		batchSize := hs.BatchSize
+		if batchSize <= 0 {
+			batchSize = DefaultBatchSize
+		}
+		for start := 0; start < len(pending); start += batchSize {
+			end := start + batchSize
+			if end > len(pending) {
+				end = len(pending)
+			}
+			job := make([]int, 0, end-start)
+			for idx := start; idx < end; idx++ {
+				job = append(job, idx)
+			}
+			jobs = append(jobs, job)
+		}
+	} else {
+		jobs = make([][]int, len(pending))
+		for idx := range pending {
+			jobs[idx] = []int{idx}
+		}
+	}
 
-		switch v := value.(type) {
-		case map[string]interface{}:
-			err = hs.saveRecordToTable(ctx, tableName.Name, t, tags, v)
-		case []map[string]interface{}:
-			err = hs.saveRecordsToTable(ctx, tableName.Name, t, tags, v)
-		default:
-			err = errors.New("read '" + tableName.Name + "(" + memcore.KeyValues(tags).ToKey() + ")' and return unknown type - " + reflect.TypeOf(value).Name())
+	run := func(job []int) {
+		if hs.BatchRead != nil {
+			hs.batchRead(ctx, tableName, pending, job, results)
+			return
 		}
-		if err != nil {
-			return err
+		idx := job[0]
+		results[idx].value, results[idx].err = hs.read(ctx, tableName, pending[idx])
+	}
+
+	concurrency := hs.ReadConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultReadConcurrency
+	}
+	if concurrency > len(jobs) {
+		concurrency = len(jobs)
+	}
+
+	if concurrency == 1 {
+		for _, job := range jobs {
+			run(job)
 		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	queue := make(chan []int)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				run(job)
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
 	}
+	close(queue)
+	wg.Wait()
 }
 
-func (hs *HookStorage) saveRecordToTable(ctx *SessionContext, tableName string, t time.Time, tags []memcore.KeyValue, record map[string]interface{}) error {
-	return hs.saveRecordsToTable(ctx, tableName, t, tags, []map[string]interface{}{record})
+// read 调用 Read 并保存结果, 多个会话同时读取同一个 (table, tags) 时只会调用一次 Read
+func (hs *HookStorage) read(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (interface{}, error) {
+	key := readKey(tableName, tags)
+	if err := hs.breakers.allow(hs.Breaker, key, time.Now()); err != nil {
+		return nil, err
+	}
+	return hs.reads.Do(key, func() (interface{}, error) {
+		return hs.readAndSave(ctx, key, tableName, tags)
+	})
+}
+
+func (hs *HookStorage) readAndSave(ctx *SessionContext, key, tableName string, tags []memcore.KeyValue) (interface{}, error) {
+	t, value, err := hs.readWithRetry(ctx, tableName, tags)
+	return hs.save(ctx, key, tableName, tags, t, value, err)
 }
 
-func (hs *HookStorage) saveRecordsToTable(ctx *SessionContext, tableName string, t time.Time, tags []memcore.KeyValue, records []map[string]interface{}) error {
-	table, err := memcore.ToTable(records)
+// save 保存读取的结果, 并更新熔断器的状态
+func (hs *HookStorage) save(ctx *SessionContext, key, tableName string, tags []memcore.KeyValue, t time.Time, value interface{}, err error) (interface{}, error) {
+	hs.breakers.done(hs.Breaker, key, tableName, tags, err, time.Now())
 	if err != nil {
-		return err
+		if t.IsZero() {
+			t = time.Now()
+		}
+		hs.Storage.Set(tableName, tags, false, t, memcore.Table{}, err)
+		return nil, err
+	}
+
+	table, isSingleValue, err := ToHookTable(value)
+	if err == nil {
+		table, err = memcore.ApplySchema(table, hs.Schemas[tableName])
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read '"+tableName+"("+memcore.KeyValues(tags).ToKey()+")' and return invalid value")
+	}
+	if err := hs.Storage.Set(tableName, tags, isSingleValue, t, table, nil); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func readKey(tableName string, tags []memcore.KeyValue) string {
+	copyed := make(memcore.KeyValues, len(tags))
+	copy(copyed, tags)
+	sort.Sort(copyed)
+	return tableName + "(" + copyed.ToKey() + ")"
+}
+
+// Delete 删除 tag 集的数据, 同时清除它的熔断器和热点记录, 用于清理已经下线的设备
+func (hs *HookStorage) Delete(tableName string, tags []memcore.KeyValue) bool {
+	key := readKey(tableName, tags)
+	match := func(k, _ string) bool {
+		return k == key
 	}
-	return hs.Storage.Set(tableName, tags, t, table, nil)
+	hs.breakers.forget(match)
+	hs.refresh.forget(match)
+	return hs.Storage.Delete(tableName, tags)
 }
 
-func (hs *HookStorage) GetPredateLimit(ctx *SessionContext) time.Time {
-	// TODO: xxx
-	return time.Now().Add(1 * time.Minute)
+// Clear 删除表的所有数据, 同时清除表的熔断器和热点记录
+func (hs *HookStorage) Clear(tableName string) int {
+	match := func(_, name string) bool {
+		return name == tableName
+	}
+	hs.breakers.forget(match)
+	hs.refresh.forget(match)
+	return hs.Storage.Clear(tableName)
+}
+
+// GetFreshness 返回 tag 集对应的有效期, 查询中指定的 Freshness 优先
+func (hs *HookStorage) GetFreshness(ctx *SessionContext, tableName string, tags []memcore.KeyValue) Freshness {
+	freshness := hs.Freshness.Get(tableName, tags)
+	if ctx.Freshness != nil {
+		freshness = ctx.Freshness.merge(freshness)
+	}
+	return freshness
+}
+
+// GetPredateLimit 返回 tag 集对应的数据和错误的有效期限, 在这之后读取的数据不需要重新读取
+func (hs *HookStorage) GetPredateLimit(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, time.Time) {
+	return hs.GetFreshness(ctx, tableName, tags).limits(time.Now())
+}
+
+type readCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// readGroup 合并对同一个 key 的并发读取, 类似于 golang.org/x/sync/singleflight
+type readGroup struct {
+	mu    sync.Mutex
+	calls map[string]*readCall
+}
+
+func (g *readGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	c, owner := g.claim(key)
+	if !owner {
+		c.wg.Wait()
+		return c.value, c.err
+	}
+
+	var value interface{}
+	var err error
+	defer func() {
+		g.finish(key, c, value, err)
+	}()
+
+	value, err = fn()
+	return value, err
+}
+
+// Go 在新的 goroutine 中执行 fn, 如果 key 已经在读取中则不执行并返回 false
+func (g *readGroup) Go(key string, fn func() (interface{}, error)) bool {
+	c, owner := g.claim(key)
+	if !owner {
+		return false
+	}
+
+	go func() {
+		var value interface{}
+		var err error
+		defer func() {
+			g.finish(key, c, value, err)
+		}()
+
+		value, err = fn()
+	}()
+	return true
+}
+
+// claim 登记对 key 的读取, 如果已经有正在进行的读取则返回它, 否则 owner 为 true,
+// 调用者在读取完成后必须调用 finish
+func (g *readGroup) claim(key string) (c *readCall, owner bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.calls == nil {
+		g.calls = map[string]*readCall{}
+	}
+	if c, ok := g.calls[key]; ok {
+		return c, false
+	}
+	c = &readCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	return c, true
+}
+
+func (g *readGroup) finish(key string, c *readCall, value interface{}, err error) {
+	c.value, c.err = value, err
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	c.wg.Done()
 }
 
 func ReadValues(values map[string][]map[string]interface{}) ReadFunc {
 	return func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
-		value, ok := values[tableName + "-" + memcore.KeyValues(tags).ToKey()]
+		value, ok := values[tableName+"-"+memcore.KeyValues(tags).ToKey()]
 		if !ok {
-			return time.Time{}, nil, memcore.ErrNotFound 
+			return time.Time{}, nil, memcore.ErrNotFound
 		}
 		return time.Now(), value, nil
 	}
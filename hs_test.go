@@ -0,0 +1,679 @@
+package memsql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/runner-mei/memsql/memcore"
+	"github.com/runner-mei/memsql/parser"
+	"github.com/runner-mei/memsql/vm"
+	"github.com/xwb1989/sqlparser"
+)
+
+func newTestSession(storage Storage) *SessionContext {
+	return &SessionContext{
+		Context: &Context{
+			Ctx:     context.Background(),
+			Storage: storage,
+		},
+		alias:      map[string]string{},
+		resultSets: map[string][]memcore.Record{},
+	}
+}
+
+func toTestKeyValues(t *testing.T, ctx *SessionContext, sqlstr string) parser.KeyValueIterator {
+	t.Helper()
+
+	stmt, err := sqlparser.Parse(sqlstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel := stmt.(*sqlparser.Select)
+	iter, err := parser.ToKeyValues(ctx, sel.Where.Expr, TableAlias{Name: "cpu"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return iter
+}
+
+func TestHookStorageReadConcurrency(t *testing.T) {
+	var running, maxRunning int32
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			old := atomic.LoadInt32(&maxRunning)
+			if n <= old || atomic.CompareAndSwapInt32(&maxRunning, old, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return time.Now(), map[string]interface{}{"f1": tags[0].Value}, nil
+	})
+	hs.ReadConcurrency = 2
+
+	ctx := newTestSession(hs)
+	iter := toTestKeyValues(t, ctx, "select * from cpu where @mo in ('1', '2', '3', '4', '5')")
+	err := hs.EnsureTables(ctx, TableAlias{Name: "cpu"}, iter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if maxRunning != 2 {
+		t.Error("want 2 concurrent reads, got", maxRunning)
+	}
+
+	reads := ctx.Debuger.Reads["cpu"]
+	if len(reads) != 5 {
+		t.Fatal("want 5 reads, got", len(reads))
+	}
+	for idx, read := range reads {
+		if read.Method != ReadOk {
+			t.Error(idx, "want ReadOk, got", read.Method, read.Error)
+		}
+		if value, _ := memcore.KeyValues(read.Tags).Get("mo"); value != string(rune('1'+idx)) {
+			t.Error(idx, "want mo =", string(rune('1'+idx)), "got", value)
+		}
+	}
+}
+
+func TestHookStorageReadDeduplicate(t *testing.T) {
+	var count int32
+	release := make(chan struct{})
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		atomic.AddInt32(&count, 1)
+		<-release
+		return time.Now(), map[string]interface{}{"f1": "a"}, nil
+	})
+
+	var wg sync.WaitGroup
+	sessions := make([]*SessionContext, 4)
+	errs := make([]error, len(sessions))
+	for i := range sessions {
+		sessions[i] = newTestSession(hs)
+		iter := toTestKeyValues(t, sessions[i], "select * from cpu where @mo = '1'")
+
+		wg.Add(1)
+		go func(i int, iter parser.KeyValueIterator) {
+			defer wg.Done()
+			errs[i] = hs.EnsureTables(sessions[i], TableAlias{Name: "cpu"}, iter)
+		}(i, iter)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if count != 1 {
+		t.Error("want 1 read, got", count)
+	}
+	for i := range sessions {
+		if errs[i] != nil {
+			t.Error(i, errs[i])
+			continue
+		}
+		reads := sessions[i].Debuger.Reads["cpu"]
+		if len(reads) != 1 || reads[0].Method != ReadOk {
+			t.Error(i, "want ReadOk, got", reads)
+		}
+	}
+}
+
+func TestHookStorageFreshness(t *testing.T) {
+	var count int32
+	var fail bool
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		atomic.AddInt32(&count, 1)
+		if fail {
+			return time.Time{}, nil, memcore.ErrNotFound
+		}
+		return time.Now(), map[string]interface{}{"f1": "a"}, nil
+	})
+	hs.Freshness = FreshnessPolicy{
+		Default: Freshness{TTL: time.Hour, ErrorTTL: time.Hour},
+		Tables: map[string]Freshness{
+			"disk": {TTL: -1},
+		},
+		ByTags: func(tableName string, tags []memcore.KeyValue) (Freshness, bool) {
+			if value, _ := memcore.KeyValues(tags).Get("mo"); value == "nocache" {
+				return Freshness{TTL: -1, ErrorTTL: -1}, true
+			}
+			return Freshness{}, false
+		},
+	}
+
+	ensure := func(ctx *SessionContext, tableName, mo string) error {
+		iter := toTestKeyValues(t, ctx, "select * from cpu where @mo = '"+mo+"'")
+		return hs.EnsureTables(ctx, TableAlias{Name: tableName}, iter)
+	}
+	assertCount := func(want int32) {
+		t.Helper()
+		if got := atomic.SwapInt32(&count, 0); got != want {
+			t.Error("want", want, "reads, got", got)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := ensure(newTestSession(hs), "cpu", "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCount(1)
+
+	for i := 0; i < 2; i++ {
+		if err := ensure(newTestSession(hs), "disk", "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCount(2)
+
+	for i := 0; i < 2; i++ {
+		if err := ensure(newTestSession(hs), "cpu", "nocache"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCount(2)
+
+	ctx := newTestSession(hs)
+	ctx.Freshness = &Freshness{TTL: -1}
+	if err := ensure(ctx, "cpu", "1"); err != nil {
+		t.Fatal(err)
+	}
+	assertCount(1)
+
+	fail = true
+	if err := ensure(newTestSession(hs), "cpu", "2"); err == nil {
+		t.Error("want error, got ok")
+	}
+	// 错误还在有效期内, 不会重新读取, 错误由 Storage.From 返回
+	ctx = newTestSession(hs)
+	if err := ensure(ctx, "cpu", "2"); err != nil {
+		t.Error(err)
+	}
+	if reads := ctx.Debuger.Reads["cpu"]; len(reads) != 1 || reads[0].Method != ReadSkip {
+		t.Error("want ReadSkip, got", reads)
+	}
+	assertCount(1)
+
+	ctx = newTestSession(hs)
+	ctx.Freshness = &Freshness{ErrorTTL: -1}
+	if err := ensure(ctx, "cpu", "2"); err == nil {
+		t.Error("want error, got ok")
+	}
+	assertCount(1)
+}
+
+func TestHookStorageStaleWhileRevalidate(t *testing.T) {
+	var count int32
+	refreshed := make(chan struct{}, 10)
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		n := atomic.AddInt32(&count, 1)
+		if n > 1 {
+			defer func() { refreshed <- struct{}{} }()
+		}
+		return time.Now(), map[string]interface{}{"f1": int64(n)}, nil
+	})
+	defer hs.Close()
+	hs.Freshness.Default = Freshness{TTL: 10 * time.Millisecond, MaxStale: time.Hour}
+
+	ensure := func() *SessionContext {
+		ctx := newTestSession(hs)
+		iter := toTestKeyValues(t, ctx, "select * from cpu where @mo = '1'")
+		if err := hs.EnsureTables(ctx, TableAlias{Name: "cpu"}, iter); err != nil {
+			t.Fatal(err)
+		}
+		return ctx
+	}
+
+	ensure()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx := ensure()
+	if reads := ctx.Debuger.Reads["cpu"]; len(reads) != 1 || reads[0].Method != ReadStale {
+		t.Error("want ReadStale, got", reads)
+	}
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("background refresh timeout")
+	}
+
+	ctx = ensure()
+	if reads := ctx.Debuger.Reads["cpu"]; len(reads) != 1 || reads[0].Method != ReadSkip {
+		t.Error("want ReadSkip, got", reads)
+	}
+}
+
+func TestHookStorageRefreshHot(t *testing.T) {
+	var count int32
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		atomic.AddInt32(&count, 1)
+		return time.Now(), map[string]interface{}{"f1": "a"}, nil
+	})
+	hs.Freshness.Default = Freshness{TTL: 30 * time.Millisecond}
+	hs.HotThreshold = 2
+	hs.Start(20 * time.Millisecond)
+
+	for _, mo := range []string{"1", "1", "2"} {
+		ctx := newTestSession(hs)
+		iter := toTestKeyValues(t, ctx, "select * from cpu where @mo = '"+mo+"'")
+		if err := hs.EnsureTables(ctx, TableAlias{Name: "cpu"}, iter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	atomic.StoreInt32(&count, 0)
+
+	time.Sleep(30 * time.Millisecond)
+	hs.Close()
+
+	// 只有 mo = 1 是热点
+	if n := atomic.LoadInt32(&count); n != 1 {
+		t.Error("want 1 refresh, got", n)
+	}
+}
+
+func TestHookStorageRetryAndBreaker(t *testing.T) {
+	var count int32
+	var failures int32 = 2
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		atomic.AddInt32(&count, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return time.Time{}, nil, errors.New("collector is down")
+		}
+		return time.Now(), map[string]interface{}{"f1": "a"}, nil
+	})
+	hs.Freshness.Default = Freshness{TTL: -1, ErrorTTL: -1}
+	hs.Retry.Default = Retry{MaxAttempts: 3, Backoff: time.Millisecond}
+	hs.Breaker = BreakerPolicy{FailureThreshold: 2, OpenTimeout: 20 * time.Millisecond}
+
+	ensure := func() (*SessionContext, error) {
+		ctx := newTestSession(hs)
+		iter := toTestKeyValues(t, ctx, "select * from cpu where @mo = '1'")
+		return ctx, hs.EnsureTables(ctx, TableAlias{Name: "cpu"}, iter)
+	}
+
+	// 前两次失败, 第三次重试成功
+	if _, err := ensure(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.SwapInt32(&count, 0); n != 3 {
+		t.Error("want 3 attempts, got", n)
+	}
+
+	hs.Retry.Default = Retry{}
+	atomic.StoreInt32(&failures, 100)
+	for i := 0; i < 2; i++ {
+		if _, err := ensure(); err == nil {
+			t.Error("want error, got ok")
+		}
+	}
+
+	stats := hs.BreakerStats()
+	if len(stats) != 1 || stats[0].State != BreakerOpen || stats[0].Failures != 2 {
+		t.Fatal("want breaker is open, got", stats)
+	}
+
+	ctx, err := ensure()
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) {
+		t.Error("want CircuitOpenError, got", err)
+	}
+	if reads := ctx.Debuger.Reads["cpu"]; len(reads) != 1 || reads[0].Method != ReadRejected || reads[0].Breaker.State != BreakerOpen {
+		t.Error("want ReadRejected, got", reads)
+	}
+	if n := atomic.SwapInt32(&count, 0); n != 2 {
+		t.Error("want 2 attempts, got", n)
+	}
+
+	// 熔断超时后允许一次尝试, 成功后熔断器关闭
+	time.Sleep(30 * time.Millisecond)
+	atomic.StoreInt32(&failures, 0)
+	if _, err := ensure(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := hs.BreakerStats(); len(stats) != 0 {
+		t.Error("want breaker is closed, got", stats)
+	}
+}
+
+func TestHookStorageBatchRead(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]string
+	hs := NewHookStorage(memcore.NewStorage(), nil)
+	hs.BatchSize = 2
+	hs.BatchRead = func(ctx *SessionContext, tableName string, tagsList [][]memcore.KeyValue) ([]BatchResult, error) {
+		var mos []string
+		var results []BatchResult
+		for _, tags := range tagsList {
+			mo, _ := memcore.KeyValues(tags).Get("mo")
+			mos = append(mos, mo)
+			if mo == "3" {
+				results = append(results, BatchResult{Err: errors.New("mo 3 is down")})
+				continue
+			}
+			results = append(results, BatchResult{Time: time.Now(), Value: map[string]interface{}{"f1": mo}})
+		}
+		mu.Lock()
+		batches = append(batches, mos)
+		mu.Unlock()
+		return results, nil
+	}
+
+	ctx := newTestSession(hs)
+	iter := toTestKeyValues(t, ctx, "select * from cpu where @mo in ('1', '2', '3', '4', '5')")
+	err := hs.EnsureTables(ctx, TableAlias{Name: "cpu"}, iter)
+	if err == nil || err.Error() != "mo 3 is down" {
+		t.Error("want error 'mo 3 is down', got", err)
+	}
+
+	if len(batches) != 3 {
+		t.Error("want 3 batches, got", batches)
+	}
+	for _, mos := range batches {
+		if len(mos) > 2 {
+			t.Error("batch is too large:", mos)
+		}
+	}
+
+	reads := ctx.Debuger.Reads["cpu"]
+	if len(reads) != 5 {
+		t.Fatal("want 5 reads, got", len(reads))
+	}
+	for idx, read := range reads {
+		want := ReadOk
+		if idx == 2 {
+			want = ReadError
+		}
+		if read.Method != want {
+			t.Error(idx, "want", want, "got", read.Method, read.Error)
+		}
+	}
+
+	// Read 为 nil 时后台刷新也使用 BatchRead
+	batches = nil
+	if _, _, err := hs.readOne(ctx, "cpu", []memcore.KeyValue{{Key: "mo", Value: "9"}}); err != nil {
+		t.Error(err)
+	}
+	if len(batches) != 1 || len(batches[0]) != 1 || batches[0][0] != "9" {
+		t.Error("want one batch with mo 9, got", batches)
+	}
+}
+
+func TestToHookTable(t *testing.T) {
+	type Base struct {
+		ID int64 `json:"id"`
+	}
+	type Metric struct {
+		Base
+		Name    string  `json:"name"`
+		Usage   float64 `memsql:"usage" json:"cpu_usage"`
+		Ignored string  `json:"-"`
+		hidden  string
+	}
+
+	for _, test := range []struct {
+		name          string
+		value         interface{}
+		columns       []string
+		rows          int
+		isSingleValue bool
+	}{
+		{name: "map", value: map[string]interface{}{"a": 1}, columns: []string{"a"}, rows: 1, isSingleValue: true},
+		{name: "maps", value: []map[string]interface{}{{"a": 1}, {"a": 2}}, columns: []string{"a"}, rows: 2},
+		{name: "struct", value: Metric{Base: Base{ID: 1}, Name: "a", Usage: 0.5}, columns: []string{"id", "name", "usage"}, rows: 1, isSingleValue: true},
+		{name: "struct ptr", value: &Metric{Name: "a"}, columns: []string{"id", "name", "usage"}, rows: 1, isSingleValue: true},
+		{name: "structs", value: []Metric{{Name: "a"}, {Name: "b"}}, columns: []string{"id", "name", "usage"}, rows: 2},
+		{name: "struct ptrs", value: []*Metric{{Name: "a"}, nil}, columns: []string{"id", "name", "usage"}, rows: 1},
+		{name: "json object", value: json.RawMessage(`{"a": 1}`), columns: []string{"a"}, rows: 1, isSingleValue: true},
+		{name: "json array", value: json.RawMessage(`[{"a": 1}, {"a": 2.5}]`), columns: []string{"a"}, rows: 2},
+		{name: "table", value: memcore.Table{Columns: []memcore.Column{{Name: "a"}}, Records: [][]memcore.Value{{vm.IntToValue(1)}}}, columns: []string{"a"}, rows: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			table, isSingleValue, err := ToHookTable(test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var columns []string
+			for _, column := range table.Columns {
+				columns = append(columns, column.Name)
+			}
+			if strings.Join(columns, ",") != strings.Join(test.columns, ",") {
+				t.Error("want columns", test.columns, "got", columns)
+			}
+			if len(table.Records) != test.rows {
+				t.Error("want", test.rows, "rows, got", len(table.Records))
+			}
+			if isSingleValue != test.isSingleValue {
+				t.Error("want isSingleValue is", test.isSingleValue, "got", isSingleValue)
+			}
+		})
+	}
+
+	for _, value := range []interface{}{nil, (*Metric)(nil), 1, json.RawMessage(`1`)} {
+		if _, _, err := ToHookTable(value); err == nil {
+			t.Errorf("%#v: want error", value)
+		}
+	}
+}
+
+func TestHookStorageSchemas(t *testing.T) {
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		mo, _ := memcore.KeyValues(tags).Get("mo")
+		return time.Now(), map[string]interface{}{"name": "m" + mo, "usage": 1, "extra": mo}, nil
+	})
+	hs.Schemas = map[string]*memcore.Schema{
+		"cpu": {Columns: []memcore.ColumnSchema{{Name: "usage", Type: vm.ValueFloat64}, {Name: "name"}}},
+	}
+	ctx := &Context{
+		Ctx:     context.Background(),
+		Storage: hs,
+	}
+
+	for i := 0; i < 5; i++ {
+		results, err := Execute(ctx, "select * from cpu where @mo in ('2', '1')")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for _, r := range results {
+			var names []string
+			for _, column := range r.Columns {
+				names = append(names, column.Name)
+			}
+			var sb strings.Builder
+			r.ToLine(&sb, ",")
+			lines = append(lines, strings.Join(names, ",")+"="+sb.String())
+		}
+		want := `usage,name,extra=1,"m1","1"` + "\n" + `usage,name,extra=1,"m2","2"`
+		if strings.Join(lines, "\n") != want {
+			t.Fatal("want", want, "got", lines)
+		}
+		if results[0].Values[0].Type != vm.ValueFloat64 {
+			t.Error("want usage is float, got", results[0].Values[0].Type)
+		}
+	}
+}
+
+func TestHookStorageListTags(t *testing.T) {
+	var mu sync.Mutex
+	var reads []string
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		mo, _ := memcore.KeyValues(tags).Get("mo")
+		mu.Lock()
+		reads = append(reads, mo)
+		mu.Unlock()
+		return time.Now(), map[string]interface{}{"f1": mo}, nil
+	})
+	hs.ReadConcurrency = 1
+	hs.ListTags = func(ctx *SessionContext, tableName string) ([][]memcore.KeyValue, error) {
+		return [][]memcore.KeyValue{
+			{{Key: "mo", Value: "1"}},
+			{{Key: "mo", Value: "2"}},
+			{{Key: "mo", Value: "3"}},
+		}, nil
+	}
+
+	for _, test := range []struct {
+		sql   string
+		reads string
+		count int
+	}{
+		{sql: "select * from cpu", reads: "1,2,3", count: 3},
+		{sql: "select * from cpu where f1 = '3'", reads: "1,2,3", count: 1},
+		{sql: "select * from cpu where @mo = '2'", reads: "2", count: 1},
+		{sql: "select * from cpu where @mo = '2' or @mo = '3'", reads: "2,3", count: 2},
+		{sql: "select * from cpu where @mo <> '2'", reads: "1,3", count: 2},
+		{sql: "select * from cpu where @mo not in ('1', '2')", reads: "3", count: 1},
+		{sql: "select * from cpu where @mo like '%2'", reads: "2", count: 1},
+		{sql: "select * from cpu where @mo between '2' and '3'", reads: "2,3", count: 2},
+	} {
+		reads = nil
+		hs.Storage = memcore.NewStorage()
+
+		results, err := Execute(&Context{Ctx: context.Background(), Storage: hs}, test.sql)
+		if err != nil {
+			t.Error(test.sql, err)
+			continue
+		}
+		if len(results) != test.count {
+			t.Error(test.sql, "want", test.count, "records, got", len(results))
+		}
+		if got := strings.Join(reads, ","); got != test.reads {
+			t.Error(test.sql, "want reads", test.reads, "got", got)
+		}
+	}
+}
+
+func TestHookStorageListTagsHeterogeneous(t *testing.T) {
+	var mu sync.Mutex
+	var reads []string
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		mu.Lock()
+		reads = append(reads, memcore.KeyValues(tags).ToKey())
+		mu.Unlock()
+		return time.Now(), map[string]interface{}{"f1": "a"}, nil
+	})
+	hs.ReadConcurrency = 1
+	// 只有部分 tag 集有 region
+	hs.ListTags = func(ctx *SessionContext, tableName string) ([][]memcore.KeyValue, error) {
+		return [][]memcore.KeyValue{
+			{{Key: "mo", Value: "1"}, {Key: "region", Value: "cn-1"}},
+			{{Key: "mo", Value: "2"}},
+			{{Key: "mo", Value: "3"}, {Key: "region", Value: "us-1"}},
+		}, nil
+	}
+
+	results, err := Execute(&Context{Ctx: context.Background(), Storage: hs}, "select * from cpu where @region like 'cn-%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Error("want 1 record, got", len(results))
+	}
+	if got := strings.Join(reads, ";"); got != "mo=1,region=cn-1" {
+		t.Error("want reads mo=1,region=cn-1 got", got)
+	}
+}
+
+func TestHookStoragePartiallyEnumerable(t *testing.T) {
+	var mu sync.Mutex
+	var reads []string
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		mu.Lock()
+		reads = append(reads, memcore.KeyValues(tags).ToKey())
+		mu.Unlock()
+		return time.Now(), map[string]interface{}{"f1": "a"}, nil
+	})
+	hs.ReadConcurrency = 1
+	hs.ListTags = func(ctx *SessionContext, tableName string) ([][]memcore.KeyValue, error) {
+		return [][]memcore.KeyValue{
+			{{Key: "mo", Value: "1"}, {Key: "region", Value: "cn-1"}},
+			{{Key: "mo", Value: "1"}, {Key: "region", Value: "us-1"}},
+			{{Key: "mo", Value: "2"}, {Key: "region", Value: "cn-2"}},
+		}, nil
+	}
+
+	// region 不能枚举, 不能只读取 {mo=1}, 需要枚举所有的 tag 集
+	results, err := Execute(&Context{Ctx: context.Background(), Storage: hs}, "select * from cpu where @mo='1' and @region like 'cn-%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Error("want 1 record, got", len(results))
+	}
+	if got := strings.Join(reads, ";"); got != "mo=1,region=cn-1" {
+		t.Error("want reads mo=1,region=cn-1 got", got)
+	}
+}
+
+func TestHookStorageNotEnumerable(t *testing.T) {
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		return time.Now(), map[string]interface{}{"f1": "a"}, nil
+	})
+
+	_, err := Execute(&Context{Ctx: context.Background(), Storage: hs}, "select * from cpu where @mo like '1%'")
+	if err == nil || !strings.Contains(err.Error(), "ListTags is required") {
+		t.Error("want ListTags is required, got", err)
+	}
+}
+
+func TestHookStorageOnError(t *testing.T) {
+	hs := NewHookStorage(memcore.NewStorage(), func(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (time.Time, interface{}, error) {
+		if mo, _ := memcore.KeyValues(tags).Get("mo"); mo == "2" {
+			return time.Time{}, nil, errors.New("mo 2 is down")
+		}
+		return time.Now(), map[string]interface{}{"f1": "a"}, nil
+	})
+	const sql = "select @mo, @_err from cpu where @mo in ('1', '2', '3') order by @mo"
+
+	_, err := Execute(&Context{Ctx: context.Background(), Storage: hs}, sql)
+	if err == nil || err.Error() != "mo 2 is down" {
+		t.Error("want error 'mo 2 is down', got", err)
+	}
+
+	for _, test := range []struct {
+		onError memcore.ErrorPolicy
+		want    []string
+		skipped int
+	}{
+		{onError: memcore.ErrorSkip, want: []string{`"1",null`, `"3",null`}, skipped: 1},
+		{onError: memcore.ErrorAsRow, want: []string{`"1",null`, `"2","mo 2 is down"`, `"3",null`}},
+	} {
+		ctx := &Context{Ctx: context.Background(), Storage: hs, OnError: test.onError}
+		results, err := Execute(ctx, sql)
+		if err != nil {
+			t.Error(test.onError, err)
+			continue
+		}
+		var lines []string
+		for _, r := range results {
+			var sb strings.Builder
+			r.ToLine(&sb, ",")
+			lines = append(lines, sb.String())
+		}
+		if strings.Join(lines, "\n") != strings.Join(test.want, "\n") {
+			t.Error(test.onError, "want", test.want, "got", lines)
+		}
+		if len(ctx.Debuger.Skipped) != test.skipped {
+			t.Error(test.onError, "want", test.skipped, "skipped, got", ctx.Debuger.Skipped)
+		} else if test.skipped > 0 && ctx.Debuger.Skipped[0].Name.Tags.ToKey() != "mo=2" {
+			t.Error(test.onError, "want mo=2 skipped, got", ctx.Debuger.Skipped[0].Name)
+		}
+	}
+}
+
+func TestHookStorageWithoutRead(t *testing.T) {
+	hs := NewHookStorage(memcore.NewStorage(), nil)
+
+	_, err := Execute(&Context{Ctx: context.Background(), Storage: hs}, "select * from cpu where @mo = '1'")
+	if err == nil || !strings.Contains(err.Error(), "Read or BatchRead is required") {
+		t.Error("want Read or BatchRead is required, got", err)
+	}
+}
@@ -0,0 +1,235 @@
+package memsql
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/memsql/memcore"
+	"github.com/runner-mei/memsql/parser"
+	"github.com/runner-mei/memsql/vm"
+	"github.com/xwb1989/sqlparser"
+)
+
+// InformationSchema 是虚拟表的限定名, 支持的表有
+//
+//   - information_schema.tables  列为 table_name 和 source
+//   - information_schema.columns 列为 table_name, column_name, kind 和 ordinal_position
+//   - information_schema.tags    列为 table_name, tag_key 和 tag_value
+//
+// 它们在查询时根据 Storage 和 Foreign 的元数据生成
+const InformationSchema = "information_schema"
+
+// informationSchemaTable 生成名为 name 的虚拟表, tableNames 不为 nil 时 columns 和 tags 只包含其中的表
+func informationSchemaTable(ctx *SessionContext, name string, tableNames map[string]struct{}) (memcore.Table, error) {
+	switch name {
+	case "tables":
+		table, err := showTables(ctx)
+		if err != nil {
+			return memcore.Table{}, err
+		}
+		table.Columns[0].Name = "table_name"
+		return table, nil
+	case "columns":
+		return informationSchemaColumns(ctx, tableNames)
+	case "tags":
+		return informationSchemaTags(ctx, tableNames)
+	default:
+		return memcore.Table{}, memcore.TableNotExists(InformationSchema + "." + name)
+	}
+}
+
+// informationSchemaColumns 需要读取每个表的数据, 读取出错的表会被跳过, 并记录在 Debuger.Skipped 中
+func informationSchemaColumns(ctx *SessionContext, tableNames map[string]struct{}) (memcore.Table, error) {
+	tables, err := showTables(ctx)
+	if err != nil {
+		return memcore.Table{}, err
+	}
+
+	result := newMetaTable("table_name", "column_name", "kind", "ordinal_position")
+	for _, record := range tables.Records {
+		tableName := record[0].Str
+		if !containsTableName(tableNames, tableName) {
+			continue
+		}
+		columns, err := describeTable(ctx, tableName)
+		if err != nil {
+			if !errors.Is(err, errors.ErrTableNotExists) {
+				ctx.Debuger.SkipMeasurement(memcore.TableName{Table: tableName}, err)
+			}
+			continue
+		}
+		for idx, column := range columns.Records {
+			result.Records = append(result.Records, []memcore.Value{
+				vm.StringToValue(tableName),
+				column[0],
+				column[1],
+				vm.IntToValue(int64(idx + 1)),
+			})
+		}
+	}
+	return result, nil
+}
+
+func informationSchemaTags(ctx *SessionContext, tableNames map[string]struct{}) (memcore.Table, error) {
+	ms, err := ctx.metadataStorage()
+	if err != nil {
+		return memcore.Table{}, err
+	}
+	names, err := ms.Tables(ctx)
+	if err != nil {
+		return memcore.Table{}, err
+	}
+
+	result := newMetaTable("table_name", "tag_key", "tag_value")
+	for _, tableName := range names {
+		if !containsTableName(tableNames, tableName) {
+			continue
+		}
+		tagsList, err := ms.TagSets(ctx, tableName)
+		if err != nil {
+			if !errors.Is(err, errors.ErrTableNotExists) {
+				ctx.Debuger.SkipMeasurement(memcore.TableName{Table: tableName}, err)
+			}
+			continue
+		}
+
+		seen := map[memcore.KeyValue]struct{}{}
+		var tags []memcore.KeyValue
+		for _, tagSet := range tagsList {
+			for _, tag := range tagSet {
+				if _, ok := seen[tag]; ok {
+					continue
+				}
+				seen[tag] = struct{}{}
+				tags = append(tags, tag)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool {
+			if tags[i].Key != tags[j].Key {
+				return tags[i].Key < tags[j].Key
+			}
+			return tags[i].Value < tags[j].Value
+		})
+		for _, tag := range tags {
+			addMetaRecord(&result, tableName, tag.Key, tag.Value)
+		}
+	}
+	return result, nil
+}
+
+// executeInformationSchema 查询 information_schema 中的虚拟表, 虚拟表在第一次读取时才生成
+func executeInformationSchema(ec *SessionContext, ds Datasource, where *sqlparser.Where, hasJoin bool) (memcore.Query, error) {
+	name := strings.ToLower(ds.Table)
+	switch name {
+	case "tables", "columns", "tags":
+	default:
+		return memcore.Query{}, memcore.TableNotExists(InformationSchema + "." + ds.Table)
+	}
+
+	var whereExpr sqlparser.Expr
+	if where != nil {
+		whereExpr = where.Expr
+	}
+	debuger := ec.Debuger.NewTable(ds.Table, ds.As, whereExpr)
+	if hasJoin && whereExpr != nil {
+		var err error
+		whereExpr, err = parser.SplitByTableName(whereExpr, ds.Table, ds.As)
+		if err != nil {
+			return memcore.Query{}, err
+		}
+	}
+	if debuger != nil {
+		debuger.SetWhere(whereExpr)
+	}
+	tableNames := tableNamesOf(whereExpr, ds)
+
+	query := memcore.Query{
+		Iterate: func() memcore.Iterator {
+			table, err := informationSchemaTable(ec, name, tableNames)
+			if err != nil {
+				return func(memcore.Context) (memcore.Record, error) {
+					return memcore.Record{}, err
+				}
+			}
+			for idx := range table.Columns {
+				table.Columns[idx].TableName = ds.Table
+			}
+			return memcore.From(table).Iterate()
+		},
+	}
+
+	// 先改名, 条件中才能使用别名引用列
+	if ds.As != "" {
+		query = query.Map(RenameTableToAlias(ds.As))
+	}
+	query, err := ExecuteWhere(ec, query, whereExpr)
+	if err != nil {
+		return memcore.Query{}, err
+	}
+	if debuger != nil {
+		return debuger.Track(query), nil
+	}
+	return query, nil
+}
+
+// tableNamesOf 从 where 中取出 table_name 的等值条件, 这样 columns 和 tags 只需要读取这些表,
+// 取不出来时返回 nil. 取出的条件仍然会在 ExecuteWhere 中检查, 所以 and 的两边只需要用一边
+func tableNamesOf(expr sqlparser.Expr, ds Datasource) map[string]struct{} {
+	switch v := expr.(type) {
+	case *sqlparser.AndExpr:
+		if names := tableNamesOf(v.Left, ds); names != nil {
+			return names
+		}
+		return tableNamesOf(v.Right, ds)
+	case *sqlparser.ParenExpr:
+		return tableNamesOf(v.Expr, ds)
+	case *sqlparser.ComparisonExpr:
+		var literals []sqlparser.Expr
+		switch v.Operator {
+		case sqlparser.EqualStr:
+			if isTableNameColumn(v.Left, ds) {
+				literals = []sqlparser.Expr{v.Right}
+			} else if isTableNameColumn(v.Right, ds) {
+				literals = []sqlparser.Expr{v.Left}
+			}
+		case sqlparser.InStr:
+			if tuple, ok := v.Right.(sqlparser.ValTuple); ok && isTableNameColumn(v.Left, ds) {
+				literals = tuple
+			}
+		}
+		if len(literals) == 0 {
+			return nil
+		}
+		names := map[string]struct{}{}
+		for _, literal := range literals {
+			value, ok := literal.(*sqlparser.SQLVal)
+			if !ok || value.Type != sqlparser.StrVal {
+				return nil
+			}
+			names[string(value.Val)] = struct{}{}
+		}
+		return names
+	}
+	return nil
+}
+
+func isTableNameColumn(expr sqlparser.Expr, ds Datasource) bool {
+	column, ok := expr.(*sqlparser.ColName)
+	if !ok {
+		return false
+	}
+	tableName, name := toColumnName(column)
+	if name != "table_name" {
+		return false
+	}
+	return tableName == "" || strings.EqualFold(tableName, ds.Table) || strings.EqualFold(tableName, ds.As)
+}
+
+func containsTableName(tableNames map[string]struct{}, tableName string) bool {
+	if tableNames == nil {
+		return true
+	}
+	_, ok := tableNames[tableName]
+	return ok
+}
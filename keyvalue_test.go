@@ -38,7 +38,7 @@ func TestKeyValues(t *testing.T) {
 		t.Error(err)
 		return 
 	}
-	storage.Set("mo_list", nil, time.Now(), table, nil)
+	storage.Set("mo_list", nil, false, time.Now(), table, nil)
 
 	ctx := &Context{
 		Ctx:     context.Background(),
@@ -111,6 +111,24 @@ func TestKeyValues(t *testing.T) {
 				},
 			},
 		},
+		{
+			sql:       "select a from abc where @mo=1 or @mo=2 or @mo=1",
+			qualifier: "",
+			keyvalues: [][]KeyValue{
+				[]KeyValue{
+					KeyValue{
+						Key:   "mo",
+						Value: "1",
+					},
+				},
+				[]KeyValue{
+					KeyValue{
+						Key:   "mo",
+						Value: "2",
+					},
+				},
+			},
+		},
 		{
 			sql:       "select a from abc where @mo in (1, 2)",
 			qualifier: "",
@@ -417,3 +435,33 @@ func TestKeyValues(t *testing.T) {
 		})
 	}
 }
+
+func TestKeyValuesNotEnumerable(t *testing.T) {
+	for _, sqlstr := range []string{
+		"select a from abc where @mo=1 or a=2",
+		"select a from abc where @mo <> 1",
+		"select a from abc where @mo not in (1, 2)",
+		"select a from abc where @region like 'cn-%'",
+		"select a from abc where @mo between 1 and 5",
+		"select a from abc where @mo > 1 or @mo = 0",
+		"select a from abc where not (@mo = 1)",
+		"select a from abc where @mo='1' and @region like 'cn-%'",
+		"select a from abc where @b=2 and (@mo=1 or @mo=3) and @region like 'cn-%'",
+		"select a from abc where @mo=1 and (a=2 or @region like 'cn-%')",
+	} {
+		stmt, err := sqlparser.Parse(sqlstr)
+		if err != nil {
+			t.Error(sqlstr, err)
+			continue
+		}
+		sel, _ := stmt.(*sqlparser.Select)
+		iter, err := parser.ToKeyValues(nil, sel.Where.Expr, TableAlias{}, nil)
+		if err != nil {
+			t.Error(sqlstr, err)
+			continue
+		}
+		if iter != nil {
+			t.Error(sqlstr, "want nil iterator")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package memcore
+
+import (
+	"errors"
+
+	"github.com/runner-mei/memsql/memcore/records"
+)
+
+type ColumnarTable = records.ColumnarTable
+type Vector = records.Vector
+
+// ErrNoBatches 表示查询不能按列读取, 这时只能用 Iterate 读取
+var ErrNoBatches = errors.New("query cannot be read as batches")
+
+// Batch 是一个 measurement 按列存储的数据
+type Batch struct {
+	Table *ColumnarTable
+	Tags  KeyValues
+	Meta  *RecordMeta
+
+	// Selection 是选中的行号, 为 nil 时表示所有行
+	Selection []int
+}
+
+// Length 返回选中的行数
+func (b *Batch) Length() int {
+	if b.Selection == nil {
+		return b.Table.Length()
+	}
+	return len(b.Selection)
+}
+
+// Row 返回第 idx 个选中的行的行号
+func (b *Batch) Row(idx int) int {
+	if b.Selection == nil {
+		return idx
+	}
+	return b.Selection[idx]
+}
+
+// Record 返回第 idx 个选中的行, 它和 Iterate 返回的记录相同
+func (b *Batch) Record(idx int) Record {
+	r := b.Table.At(b.Row(idx))
+	r.Tags = b.Tags
+	r.Meta = b.Meta
+	return r
+}
+
+// ReadBatches 按列读取查询的数据, 不能按列读取时返回 ErrNoBatches
+func (q Query) ReadBatches() ([]Batch, error) {
+	if q.Batches == nil {
+		return nil, ErrNoBatches
+	}
+	return q.Batches()
+}
+
+// WhereBatches 同 Where, 但按列读取时用 selector 选择每一批中的行,
+// selector 返回的行号必须是 batch 中已选中的行, 并且顺序不变
+func (q Query) WhereBatches(predicate func(int, Record) (bool, error), selector func(Batch) ([]int, error)) Query {
+	query := q.Where(predicate)
+	if q.Batches != nil {
+		query.Batches = func() ([]Batch, error) {
+			batches, err := q.Batches()
+			if err != nil {
+				return nil, err
+			}
+			results := make([]Batch, 0, len(batches))
+			for _, batch := range batches {
+				selection, err := selector(batch)
+				if err != nil {
+					return nil, err
+				}
+				if len(selection) == 0 {
+					continue
+				}
+				batch.Selection = selection
+				results = append(results, batch)
+			}
+			return results, nil
+		}
+	}
+	return query
+}
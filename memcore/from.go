@@ -19,6 +19,9 @@ type Iterator func(Context) (item Record, err error)
 // as shown in the example.
 type Query struct {
 	Iterate func() Iterator
+
+	// Batches 不为 nil 时可以按列读取数据, 它和 Iterate 返回相同的记录, 见 ReadBatches
+	Batches func() ([]Batch, error)
 }
 
 // Iterable is an interface that has to be implemented by a custom collection in
@@ -36,6 +39,25 @@ func From(source Table) Query {
 }
 
 func FromWithTags(source Table, tags KeyValues) Query {
+	return fromWithMeta(source, tags, nil)
+}
+
+// FromMeasurement 同 FromWithTags, 但记录中带有 measurement 的信息, 可以读取伪列
+//
+// measurement 读取出错并且没有数据时, 返回一条只有 tag 的记录
+func FromMeasurement(m Measurement) Query {
+	meta := &RecordMeta{
+		Table: m.Name.Table,
+		Time:  m.Time,
+		Err:   m.Err,
+	}
+	if m.Err != nil && m.Data.Length() == 0 {
+		return FromRecords([]Record{{Tags: m.Name.Tags, Meta: meta}})
+	}
+	return fromWithMeta(m.Data, m.Name.Tags, meta)
+}
+
+func fromWithMeta(source Table, tags KeyValues, meta *RecordMeta) Query {
 	return Query{
 		Iterate: func() Iterator {
 			index := 0
@@ -44,6 +66,7 @@ func FromWithTags(source Table, tags KeyValues) Query {
 				if index < source.Length() {
 					item = source.At(index)
 					item.Tags = tags
+					item.Meta = meta
 					index++
 					return
 				}
@@ -52,6 +75,16 @@ func FromWithTags(source Table, tags KeyValues) Query {
 				return
 			}
 		},
+		Batches: func() ([]Batch, error) {
+			if source.Length() == 0 {
+				return nil, nil
+			}
+			return []Batch{{
+				Table: source.Columnar(),
+				Tags:  tags,
+				Meta:  meta,
+			}}, nil
+		},
 	}
 }
 
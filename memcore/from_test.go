@@ -1,7 +1,10 @@
 package memcore
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/runner-mei/memsql/vm"
 )
@@ -48,3 +51,48 @@ func TestFromChannel(t *testing.T) {
 		t.Errorf("FromChannel() failed expected %v", w)
 	}
 }
+
+func TestFromStorageAlignsColumns(t *testing.T) {
+	storage := NewStorage()
+	set := func(mo string, columns []Column, values ...Value) {
+		err := storage.Set("cpu", []KeyValue{{Key: "mo", Value: mo}}, false, time.Now(), Table{Columns: columns, Records: [][]Value{values}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("1", []Column{{Name: "a"}, {Name: "c"}}, vm.IntToValue(1), vm.IntToValue(3))
+	set("2", []Column{{Name: "a"}, {Name: "b"}}, vm.IntToValue(4), vm.IntToValue(5))
+	set("3", []Column{{Name: "b"}}, vm.IntToValue(6))
+
+	q, err := FromStorage(storage, "cpu", func(TableName) (bool, error) { return true, nil }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := q.Results(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]Value{
+		{vm.IntToValue(1), vm.IntToValue(3), vm.Null()},
+		{vm.IntToValue(4), vm.Null(), vm.IntToValue(5)},
+		{vm.Null(), vm.Null(), vm.IntToValue(6)},
+	}
+	if len(records) != len(want) {
+		t.Fatal("want", len(want), "records, got", records)
+	}
+	for idx, r := range records {
+		var names []string
+		for _, column := range r.Columns {
+			names = append(names, column.Name)
+			if column.TableName != "cpu" {
+				t.Error("want table name is cpu, got", column.TableName)
+			}
+		}
+		if strings.Join(names, ",") != "a,c,b" {
+			t.Error("want columns a,c,b, got", names)
+		}
+		if !reflect.DeepEqual(r.Values, want[idx]) {
+			t.Error("record", idx, "want", want[idx], "got", r.Values)
+		}
+	}
+}
@@ -16,3 +16,25 @@ func (q Query) Map(mapFunc func(Context, Record) (Record, error)) Query {
 		},
 	}
 }
+
+// MapBatches 同 Map, 但按列读取时用 batchFunc 转换每一批数据
+func (q Query) MapBatches(mapFunc func(Context, Record) (Record, error), batchFunc func(Batch) (Batch, error)) Query {
+	query := q.Map(mapFunc)
+	if q.Batches != nil {
+		query.Batches = func() ([]Batch, error) {
+			batches, err := q.Batches()
+			if err != nil {
+				return nil, err
+			}
+			results := make([]Batch, len(batches))
+			for idx := range batches {
+				results[idx], err = batchFunc(batches[idx])
+				if err != nil {
+					return nil, err
+				}
+			}
+			return results, nil
+		}
+	}
+	return query
+}
@@ -1,6 +1,9 @@
 package memcore
 
 import (
+	"database/sql"
+	"time"
+
 	"github.com/runner-mei/errors"
 	"github.com/runner-mei/memsql/memcore/records"
 	"github.com/runner-mei/memsql/vm"
@@ -21,7 +24,12 @@ type TableName = records.TableName
 type Column = records.Column
 type KeyValue = records.KeyValue
 type KeyValues = records.KeyValues
+type RecordMeta = records.RecordMeta
+
 
+func CloneKeyValues(keyValues []KeyValue) []KeyValue {
+	return records.CloneKeyValues(keyValues)
+}
 
 func mkColumn(name string) Column {
 	return records.MkColumn(name)
@@ -31,14 +39,79 @@ type Measurement = records.Measurement
 type Storage = records.Storage
 
 
+type HistoryPolicy = records.HistoryPolicy
+type CapacityPolicy = records.CapacityPolicy
+type StorageOptions = records.StorageOptions
+type StorageStats = records.StorageStats
+type TableStats = records.TableStats
+type StatsStorage = records.StatsStorage
+type DurableStorage = records.DurableStorage
+type DurableOptions = records.DurableOptions
+type Schema = records.Schema
+type ColumnSchema = records.ColumnSchema
+type SchemaStorage = records.SchemaStorage
+type SyncPolicy = records.SyncPolicy
+type Change = records.Change
+type ChangeOp = records.ChangeOp
+type ChangeNotifier = records.ChangeNotifier
+type WatchedStorage = records.WatchedStorage
+
+const (
+	ChangeSet    = records.ChangeSet
+	ChangeDelete = records.ChangeDelete
+	ChangeClear  = records.ChangeClear
+)
+
+func NewWatchedStorage(s Storage) *WatchedStorage {
+	return records.NewWatchedStorage(s)
+}
+
+const (
+	SyncInterval = records.SyncInterval
+	SyncAlways   = records.SyncAlways
+	SyncNever    = records.SyncNever
+)
+
 func NewStorage() Storage {
 	return records.NewStorage()
 }
 
+func NewStorageWithHistory(policy HistoryPolicy) Storage {
+	return records.NewStorageWithHistory(policy)
+}
+
+func NewStorageWithOptions(opts StorageOptions) Storage {
+	return records.NewStorageWithOptions(opts)
+}
+
+func NewSQLiteStorage(conn *sql.DB, policy HistoryPolicy) (Storage, error) {
+	return records.NewSQLiteStorage(conn, policy)
+}
+
+func OpenDurableStorage(opts DurableOptions) (*DurableStorage, error) {
+	return records.OpenDurableStorage(opts)
+}
+
 func ToTable(values []map[string]interface{}) (Table, error) {
 	return records.ToTable(values)
 }
 
+func ToTableWithSchema(values []map[string]interface{}, schema *Schema) (Table, error) {
+	return records.ToTableWithSchema(values, schema)
+}
+
+func NewSchema(names ...string) *Schema {
+	return records.NewSchema(names...)
+}
+
+func ApplySchema(table Table, schema *Schema) (Table, error) {
+	return records.ApplySchema(table, schema)
+}
+
+func ConvertValue(value Value, typ vm.ValueType) (Value, error) {
+	return records.ConvertValue(value, typ)
+}
+
 func MergeRecord(outerAs string, outer Record, innerAs string, inner Record) Record {
 	return records.MergeRecord(outerAs, outer, innerAs, inner)
 }
@@ -59,27 +132,185 @@ func MapToTags(tags map[string]string) []KeyValue {
 	return records.MapToTags(tags)
 }
 
+const (
+	PseudoTime  = records.PseudoTime
+	PseudoErr   = records.PseudoErr
+	PseudoTable = records.PseudoTable
+)
+
+func IsPseudoColumn(name string) bool {
+	return records.IsPseudoColumn(name)
+}
+
 func SortByColumnName(r Record) Record {
 	return records.SortByColumnName(r)
 }
 
 func FromStorage(s Storage, tablename string, f func(name TableName) (bool, error), trace func(TableName)) (Query, error) {
-	list, err := s.From(tablename, f)
+	return FromStorageByTags(s, tablename, nil, f, FromOptions{Trace: trace})
+}
+
+// ErrorPolicy 决定 FromStorage 遇到读取出错的 measurement 时怎么处理
+type ErrorPolicy int
+
+const (
+	// ErrorFail 返回 measurement 的错误, 这是默认的行为
+	ErrorFail ErrorPolicy = iota
+	// ErrorSkip 跳过出错的 measurement
+	ErrorSkip
+	// ErrorAsRow 将出错的 measurement 作为记录返回, 错误可以从 @_err 伪列读取,
+	// measurement 有上一次成功读取的数据时返回这些数据, 否则返回一条只有 tag 的记录
+	ErrorAsRow
+)
+
+// History 指定查询 measurement 的哪些历史版本, 零值表示只查询当前版本
+type History struct {
+	// All 为 true 时查询保留的所有版本
+	All bool
+	// AsOf 不为零值时查询每个 tag 集在这个时间点的版本
+	AsOf time.Time
+}
+
+func (h History) IsZero() bool {
+	return !h.All && h.AsOf.IsZero()
+}
+
+type FromOptions struct {
+	Trace   func(TableName)
+	OnError ErrorPolicy
+	// Skipped 在 OnError 为 ErrorSkip 时, 每跳过一个 measurement 调用一次
+	Skipped func(name TableName, err error)
+	History History
+}
+
+// FromStorageByTags 同 FromStorage, 但用 tagsList 通过索引查找 measurement, 见 Storage.FromTags
+func FromStorageByTags(s Storage, tablename string, tagsList [][]KeyValue, f func(name TableName) (bool, error), opts FromOptions) (Query, error) {
+	var list []Measurement
+	var err error
+	if opts.History.IsZero() {
+		list, err = s.FromTags(tablename, tagsList, f)
+	} else {
+		list, err = fromVersions(s, tablename, tagsList, f, opts.History)
+	}
 	if err != nil {
 		return Query{}, err
 	}
 	if len(list) == 0 {
 		return Query{}, TableNotExists(tablename)
 	}
-	if trace != nil {
+
+	offset := 0
+	for i := 0; i < len(list); i++ {
+		if list[i].Err != nil {
+			switch opts.OnError {
+			case ErrorSkip:
+				if opts.Skipped != nil {
+					opts.Skipped(list[i].Name, list[i].Err)
+				}
+				continue
+			case ErrorAsRow:
+			default:
+				return Query{}, list[i].Err
+			}
+		}
+		list[offset] = list[i]
+		offset++
+	}
+	list = list[:offset]
+	if len(list) == 0 {
+		// 所有的 measurement 都被跳过了
+		return FromRecords(nil), nil
+	}
+
+	if opts.Trace != nil {
 		for i := 0; i < len(list); i++ {
-			trace(list[i].Name)
+			opts.Trace(list[i].Name)
 		}
 	}
 
-	query := FromWithTags(list[0].Data, list[0].Name.Tags)
+	list, err = alignMeasurements(list)
+	if err != nil {
+		return Query{}, err
+	}
+
+	query := FromMeasurement(list[0])
 	for i := 1; i < len(list); i++ {
-		query = query.UnionAll(FromWithTags(list[i].Data, list[i].Name.Tags))
+		query = query.UnionAll(FromMeasurement(list[i]))
 	}
 	return query, nil
-}
\ No newline at end of file
+}
+
+// alignMeasurements 让同一个表的 measurement 有相同的列, 列按第一次出现的顺序排列, 缺少的值为 null,
+// 没有数据的 measurement 不参与, 列已经相同的 measurement 不会被复制
+func alignMeasurements(list []Measurement) ([]Measurement, error) {
+	var names []string
+	// index 是列名在 names 中的位置, 避免每一列都扫描一遍 names
+	index := map[string]int{}
+	aligned := true
+	for i := range list {
+		if list[i].Data.Length() == 0 {
+			continue
+		}
+		columns := list[i].Data.Columns
+		if names != nil && !columnNamesEqual(columns, names) {
+			aligned = false
+		}
+		for _, column := range columns {
+			if _, ok := index[column.Name]; !ok {
+				index[column.Name] = len(names)
+				names = append(names, column.Name)
+			}
+		}
+	}
+	if aligned {
+		return list, nil
+	}
+
+	schema := NewSchema(names...)
+	results := make([]Measurement, len(list))
+	for i := range list {
+		results[i] = list[i]
+		if list[i].Data.Length() == 0 || columnNamesEqual(list[i].Data.Columns, names) {
+			continue
+		}
+		table, err := ApplySchema(list[i].Data, schema)
+		if err != nil {
+			return nil, err
+		}
+		for idx := range table.Columns {
+			table.Columns[idx].TableName = list[i].Name.Table
+		}
+		results[i].Data = table
+	}
+	return results, nil
+}
+
+func columnNamesEqual(columns []Column, names []string) bool {
+	if len(columns) != len(names) {
+		return false
+	}
+	for idx := range columns {
+		if columns[idx].Name != names[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func fromVersions(s Storage, tablename string, tagsList [][]KeyValue, f func(name TableName) (bool, error), history History) ([]Measurement, error) {
+	list, err := s.Versions(tablename, tagsList, f, time.Time{}, history.AsOf)
+	if err != nil || history.All {
+		return list, err
+	}
+
+	// 同一个 tag 集的版本按时间从旧到新排列, 只保留每个 tag 集的最后一个版本
+	offset := 0
+	for i := range list {
+		if i+1 < len(list) && list[i+1].Name.Tags.Equal(list[i].Name.Tags) {
+			continue
+		}
+		list[offset] = list[i]
+		offset++
+	}
+	return list[:offset], nil
+}
@@ -0,0 +1,386 @@
+package records
+
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/runner-mei/memsql/vm"
+)
+
+// CapacityPolicy 限制 storage 占用的内存, 字段为 0 时表示没有限制
+//
+// 超过数量或字节数的限制时按 LRU 淘汰 measurement, 占用的字节数是估算值
+type CapacityPolicy struct {
+	// MaxMeasurements 是所有表的 measurement 总数的上限
+	MaxMeasurements int
+	// MaxBytes 是所有表占用字节数的上限
+	MaxBytes int64
+	// MaxTableMeasurements 是每个表的 measurement 数的上限
+	MaxTableMeasurements int
+	// MaxTableBytes 是每个表占用字节数的上限
+	MaxTableBytes int64
+
+	// TTL 大于 0 时, 超过 TTL 没有更新过的 measurement 会被删除
+	TTL time.Duration
+}
+
+// StorageOptions 是 NewStorageWithOptions 的参数
+type StorageOptions struct {
+	History  HistoryPolicy
+	Capacity CapacityPolicy
+
+	// Now 返回当前时间, 用于判断 TTL, 为 nil 时使用 time.Now
+	Now func() time.Time
+}
+
+// TableStats 是一个表的内存占用
+type TableStats struct {
+	Measurements int
+	Bytes        int64
+}
+
+// StorageStats 是 storage 的内存占用和计数器
+type StorageStats struct {
+	Measurements int
+	Bytes        int64
+	Tables       map[string]TableStats
+
+	// Hits 和 Misses 是 Exists 返回 true 和 false 的次数
+	Hits   uint64
+	Misses uint64
+	// Evictions 是因为超过容量而被淘汰的 measurement 数
+	Evictions uint64
+	// Expirations 是因为超过 TTL 而被删除的 measurement 数
+	Expirations uint64
+}
+
+// StatsStorage 是可以报告内存占用的 Storage
+type StatsStorage interface {
+	Stats() StorageStats
+}
+
+// usage 记录一个 measurement 占用的内存和访问顺序
+type usage struct {
+	key      string
+	size     int64
+	updated  time.Time
+	accessed uint64
+
+	lruElem *list.Element
+	ageElem *list.Element
+}
+
+// tableUsage 是一个表的 usage, lru 按访问时间从新到旧排列, ages 按更新时间从新到旧排列
+type tableUsage struct {
+	byKey map[string]*usage
+	lru   *list.List
+	ages  *list.List
+	bytes int64
+}
+
+func (s *storage) Stats() StorageStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.applyTouches()
+	s.expire(s.now())
+
+	stats := StorageStats{
+		Measurements: s.count,
+		Bytes:        s.bytes,
+		Tables:       map[string]TableStats{},
+		Hits:         atomic.LoadUint64(&s.hits),
+		Misses:       atomic.LoadUint64(&s.misses),
+		Evictions:    s.evictions,
+		Expirations:  s.expirations,
+	}
+	for name, tu := range s.usages {
+		stats.Tables[name] = TableStats{
+			Measurements: len(tu.byKey),
+			Bytes:        tu.bytes,
+		}
+	}
+	return stats
+}
+
+// touched 是读操作访问过的 measurement
+type touched struct {
+	tablename, key string
+}
+
+// maxPendingTouches 是读操作积累的访问记录的上限, 超过时读操作尝试自己更新 LRU
+const maxPendingTouches = 1024
+
+// touch 记录读操作访问过的 measurement, LRU 由写操作或 applyTouches 按访问顺序更新
+func (s *storage) touch(tablename string, keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	s.touchMu.Lock()
+	for _, key := range keys {
+		s.touches = append(s.touches, touched{tablename: tablename, key: key})
+	}
+	pending := len(s.touches)
+	s.touchMu.Unlock()
+
+	// 有写操作时由它来更新, 不需要等待
+	if pending > maxPendingTouches && s.mu.TryLock() {
+		s.applyTouches()
+		s.mu.Unlock()
+	}
+}
+
+// applyTouches 按访问顺序将读操作访问过的 measurement 移到 LRU 的最前面, 调用者必须持有 s.mu
+func (s *storage) applyTouches() {
+	s.touchMu.Lock()
+	touches := s.touches
+	s.touches = nil
+	s.touchMu.Unlock()
+
+	for _, t := range touches {
+		tu := s.usages[t.tablename]
+		if tu == nil {
+			continue
+		}
+		u := tu.byKey[t.key]
+		if u == nil {
+			continue
+		}
+		s.tick++
+		u.accessed = s.tick
+		tu.lru.MoveToFront(u.lruElem)
+	}
+}
+
+// account 在 measurement 更新后重新计算它占用的内存, 调用者必须持有 s.mu
+func (s *storage) account(tablename, key string, now time.Time) {
+	tu := s.usages[tablename]
+	if tu == nil {
+		tu = &tableUsage{
+			byKey: map[string]*usage{},
+			lru:   list.New(),
+			ages:  list.New(),
+		}
+		s.usages[tablename] = tu
+	}
+
+	size := s.sizeOf(tablename, key)
+
+	u := tu.byKey[key]
+	if u == nil {
+		u = &usage{key: key}
+		u.lruElem = tu.lru.PushFront(u)
+		u.ageElem = tu.ages.PushFront(u)
+		tu.byKey[key] = u
+		s.count++
+	} else {
+		tu.lru.MoveToFront(u.lruElem)
+		tu.ages.MoveToFront(u.ageElem)
+		tu.bytes -= u.size
+		s.bytes -= u.size
+	}
+	s.tick++
+	u.accessed = s.tick
+	u.updated = now
+	u.size = size
+	tu.bytes += size
+	s.bytes += size
+}
+
+// sizeOf 返回 measurement 和它的历史版本占用的内存, 调用者必须持有 s.mu
+func (s *storage) sizeOf(tablename, key string) int64 {
+	table := s.table(tablename)
+	size := estimateMeasurement(table.measurements[key])
+	for _, version := range table.versions[key] {
+		size += estimateMeasurement(version)
+	}
+	return size
+}
+
+// resize 重新计算 measurement 占用的内存, 不改变它的访问和更新时间, 调用者必须持有 s.mu
+func (s *storage) resize(tablename, key string) {
+	tu := s.usages[tablename]
+	if tu == nil {
+		return
+	}
+	u := tu.byKey[key]
+	if u == nil {
+		return
+	}
+	size := s.sizeOf(tablename, key)
+	tu.bytes += size - u.size
+	s.bytes += size - u.size
+	u.size = size
+}
+
+// expire 删除所有超过 TTL 的 measurement, 调用者必须持有 s.mu
+func (s *storage) expire(now time.Time) {
+	if s.capacity.TTL <= 0 {
+		return
+	}
+	for tablename, tu := range s.usages {
+		for tu.ages.Len() > 0 {
+			u := tu.ages.Back().Value.(*usage)
+			if now.Sub(u.updated) <= s.capacity.TTL {
+				break
+			}
+			s.remove(tablename, u.key)
+			s.expirations++
+		}
+	}
+}
+
+// evict 在超过容量时按 LRU 淘汰 measurement, 刚刚更新的 keep 不会被淘汰, 调用者必须持有 s.mu
+func (s *storage) evict(tablename, keep string) {
+	limits := s.capacity
+	if tu := s.usages[tablename]; tu != nil {
+		for (limits.MaxTableMeasurements > 0 && len(tu.byKey) > limits.MaxTableMeasurements) ||
+			(limits.MaxTableBytes > 0 && tu.bytes > limits.MaxTableBytes) {
+			u := tu.lru.Back().Value.(*usage)
+			if u.key == keep {
+				break
+			}
+			s.remove(tablename, u.key)
+			s.evictions++
+		}
+	}
+
+	for (limits.MaxMeasurements > 0 && s.count > limits.MaxMeasurements) ||
+		(limits.MaxBytes > 0 && s.bytes > limits.MaxBytes) {
+		// 各个表最久没有访问的 measurement 中最旧的那个
+		var oldest *usage
+		var oldestTable string
+		for name, tu := range s.usages {
+			if tu.lru.Len() == 0 {
+				continue
+			}
+			u := tu.lru.Back().Value.(*usage)
+			if name == tablename && u.key == keep {
+				if tu.lru.Len() == 1 {
+					continue
+				}
+				u = tu.lru.Back().Prev().Value.(*usage)
+			}
+			if oldest == nil || u.accessed < oldest.accessed {
+				oldest, oldestTable = u, name
+			}
+		}
+		if oldest == nil {
+			break
+		}
+		s.remove(oldestTable, oldest.key)
+		s.evictions++
+	}
+}
+
+// remove 删除 measurement 以及它的索引, 历史版本和 usage, 调用者必须持有 s.mu
+func (s *storage) remove(tablename, key string) {
+	table := s.table(tablename)
+	if table == nil {
+		return
+	}
+
+	table.mu.Lock()
+	m, ok := table.measurements[key]
+	if ok {
+		delete(table.measurements, key)
+		delete(table.updated, key)
+		delete(table.versions, key)
+		for _, tag := range m.Name.Tags {
+			posting := table.index[tag.Key+"="+tag.Value]
+			delete(posting, key)
+			if len(posting) == 0 {
+				delete(table.index, tag.Key+"="+tag.Value)
+			}
+		}
+	}
+	empty := len(table.measurements) == 0
+	table.mu.Unlock()
+	if empty {
+		s.dropTable(tablename)
+	}
+	if !ok {
+		return
+	}
+
+	if tu := s.usages[tablename]; tu != nil {
+		if u := tu.byKey[key]; u != nil {
+			tu.lru.Remove(u.lruElem)
+			tu.ages.Remove(u.ageElem)
+			delete(tu.byKey, key)
+			tu.bytes -= u.size
+			s.bytes -= u.size
+			s.count--
+		}
+		if len(tu.byKey) == 0 {
+			delete(s.usages, tablename)
+		}
+	}
+}
+
+var (
+	valueSize  = int64(unsafe.Sizeof(Value{}))
+	columnSize = int64(unsafe.Sizeof(Column{}))
+	vectorSize = int64(unsafe.Sizeof(Vector{}))
+)
+
+// estimateMeasurement 估算 measurement 占用的字节数
+func estimateMeasurement(m Measurement) int64 {
+	size := int64(unsafe.Sizeof(m))
+	for _, tag := range m.Name.Tags {
+		size += int64(len(tag.Key) + len(tag.Value))
+	}
+	for _, column := range m.Data.Columns {
+		size += columnSize + int64(len(column.Name))
+	}
+	for _, record := range m.Data.Records {
+		size += int64(len(record)) * valueSize
+		for idx := range record {
+			if record[idx].Type == vm.ValueString {
+				size += int64(len(record[idx].Str))
+			}
+		}
+	}
+	return size + estimateColumnar(m.Data)
+}
+
+// estimateColumnar 估算 Table 按列存储的形式占用的字节数, 它在第一次按列读取时生成,
+// 之后和 Table 一起保存, 所以总是计算它. 按类型存储时每行最多占 16 字节(字符串和
+// Table 共用内容), 类型混合时每行是一个 Value
+func estimateColumnar(table Table) int64 {
+	if len(table.Columns) == 0 {
+		return 0
+	}
+	rows := int64(len(table.Records))
+	size := int64(unsafe.Sizeof(ColumnarTable{}))
+	for col := range table.Columns {
+		size += vectorSize + (rows+63)/64*8
+		if isMixedColumn(table, col) {
+			size += rows * valueSize
+		} else {
+			size += rows * 16
+		}
+	}
+	return size
+}
+
+// isMixedColumn 判断 table 的第 col 列是否有多种类型的值, 同 newVector
+func isMixedColumn(table Table, col int) bool {
+	typ := vm.ValueNull
+	for _, record := range table.Records {
+		if col >= len(record) || record[col].Type == vm.ValueNull {
+			continue
+		}
+		if record[col].Type == vm.ValueAny {
+			return true
+		}
+		if typ == vm.ValueNull {
+			typ = record[col].Type
+		} else if typ != record[col].Type {
+			return true
+		}
+	}
+	return false
+}
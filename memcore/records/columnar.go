@@ -0,0 +1,198 @@
+package records
+
+import (
+	"sync"
+
+	"github.com/runner-mei/memsql/vm"
+)
+
+// Bitmap 是按位存储的布尔数组
+type Bitmap []uint64
+
+func newBitmap(length int) Bitmap {
+	return make(Bitmap, (length+63)/64)
+}
+
+func (b Bitmap) Get(idx int) bool {
+	if idx/64 >= len(b) {
+		return false
+	}
+	return b[idx/64]&(1<<uint(idx%64)) != 0
+}
+
+func (b Bitmap) Set(idx int) {
+	b[idx/64] |= 1 << uint(idx%64)
+}
+
+// Vector 是按列存储的一列值
+//
+// 所有非 null 值的类型相同时, 值按类型存在 Ints, Floats 或 Strs 中
+// (bool, int, uint, datetime 和 interval 都存在 Ints 中), 否则 Type 为 ValueAny,
+// 值存在 Values 中. 全是 null 时 Type 为 ValueNull. Nulls 中为 1 的行是 null
+type Vector struct {
+	Type   vm.ValueType
+	Ints   []int64
+	Floats []float64
+	Strs   []string
+	Values []Value
+	Nulls  Bitmap
+	Length int
+}
+
+// IsTyped 判断值是否按类型存储
+func (v *Vector) IsTyped() bool {
+	return v.Values == nil
+}
+
+// IsNull 判断第 idx 行是不是 null
+func (v *Vector) IsNull(idx int) bool {
+	return v.Nulls.Get(idx)
+}
+
+// Get 返回第 idx 行的值
+func (v *Vector) Get(idx int) Value {
+	if v.Nulls.Get(idx) {
+		return vm.Null()
+	}
+	if v.Values != nil {
+		return v.Values[idx]
+	}
+	switch v.Type {
+	case vm.ValueString:
+		return Value{Type: vm.ValueString, Str: v.Strs[idx]}
+	case vm.ValueFloat64:
+		return Value{Type: vm.ValueFloat64, Float64: v.Floats[idx]}
+	case vm.ValueNull:
+		return vm.Null()
+	default:
+		return Value{Type: v.Type, Int64: v.Ints[idx]}
+	}
+}
+
+// NewConstVector 返回 length 行值都为 value 的列
+func NewConstVector(value Value, length int) *Vector {
+	values := make([]Value, length)
+	for idx := range values {
+		values[idx] = value
+	}
+	return newVector(values)
+}
+
+func newVector(values []Value) *Vector {
+	v := &Vector{Type: vm.ValueNull, Nulls: newBitmap(len(values)), Length: len(values)}
+	mixed := false
+	for idx := range values {
+		switch values[idx].Type {
+		case vm.ValueNull:
+			v.Nulls.Set(idx)
+		case vm.ValueAny:
+			mixed = true
+		default:
+			if v.Type == vm.ValueNull {
+				v.Type = values[idx].Type
+			} else if v.Type != values[idx].Type {
+				mixed = true
+			}
+		}
+	}
+
+	if mixed {
+		v.Type = vm.ValueAny
+		v.Values = values
+		return v
+	}
+
+	switch v.Type {
+	case vm.ValueNull:
+	case vm.ValueString:
+		v.Strs = make([]string, len(values))
+		for idx := range values {
+			v.Strs[idx] = values[idx].Str
+		}
+	case vm.ValueFloat64:
+		v.Floats = make([]float64, len(values))
+		for idx := range values {
+			v.Floats[idx] = values[idx].Float64
+		}
+	default:
+		v.Ints = make([]int64, len(values))
+		for idx := range values {
+			v.Ints[idx] = values[idx].Int64
+		}
+	}
+	return v
+}
+
+// ColumnarTable 是按列存储的 Table, 行数较少的记录缺少的列为 null
+type ColumnarTable struct {
+	Columns []Column
+	Vectors []*Vector
+	Rows    int
+}
+
+// ToColumnar 将 table 转换为按列存储
+func ToColumnar(table Table) *ColumnarTable {
+	ct := &ColumnarTable{
+		Columns: table.Columns,
+		Vectors: make([]*Vector, len(table.Columns)),
+		Rows:    len(table.Records),
+	}
+	values := make([]Value, len(table.Records))
+	for col := range table.Columns {
+		for row, record := range table.Records {
+			if col < len(record) {
+				values[row] = record[col]
+			} else {
+				values[row] = vm.Null()
+			}
+		}
+		ct.Vectors[col] = newVector(values)
+		if ct.Vectors[col].Values != nil {
+			values = make([]Value, len(table.Records))
+		}
+	}
+	return ct
+}
+
+func (ct *ColumnarTable) Length() int {
+	return ct.Rows
+}
+
+// ColumnIndex 查找列, tableAs 不为空时列的表名或别名要和它相同, 找不到时返回 -1
+func (ct *ColumnarTable) ColumnIndex(tableAs, name string) int {
+	return columnSearchByQualifierName(ct.Columns, tableAs, name)
+}
+
+// At 返回第 idx 行的记录, 它和 Table.At 返回的记录相同
+func (ct *ColumnarTable) At(idx int) Record {
+	values := make([]Value, len(ct.Vectors))
+	for col := range ct.Vectors {
+		values[col] = ct.Vectors[col].Get(idx)
+	}
+	return Record{
+		Columns: ct.Columns,
+		Values:  values,
+	}
+}
+
+// columnarCache 缓存 Table 按列存储的形式, 存入 storage 的 Table 不会再修改, 只需要转换一次
+type columnarCache struct {
+	once  sync.Once
+	table *ColumnarTable
+}
+
+// Columnar 返回 table 按列存储的形式, 存入 storage 的 Table 只会转换一次
+func (table *Table) Columnar() *ColumnarTable {
+	if table.columnar == nil {
+		return ToColumnar(*table)
+	}
+	table.columnar.once.Do(func() {
+		table.columnar.table = ToColumnar(*table)
+	})
+	return table.columnar.table
+}
+
+// cacheColumnar 让 Table 缓存它按列存储的形式, 缓存在第一次调用 Columnar 时生成
+func (table *Table) cacheColumnar() {
+	table.columnar = &columnarCache{}
+}
@@ -0,0 +1,736 @@
+package records
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/memsql/vm"
+)
+
+// SyncPolicy 决定 DurableStorage 什么时候将日志 fsync 到磁盘
+type SyncPolicy int
+
+const (
+	// SyncInterval 每隔 DurableOptions.SyncInterval fsync 一次, 崩溃时最多丢失这段时间内的写入
+	SyncInterval SyncPolicy = iota
+	// SyncAlways 每次写入后都 fsync
+	SyncAlways
+	// SyncNever 不主动 fsync, 由操作系统决定什么时候写到磁盘
+	SyncNever
+)
+
+// DefaultSyncInterval 是 SyncInterval 策略下 fsync 的默认间隔
+const DefaultSyncInterval = time.Second
+
+const (
+	snapshotFile = "snapshot.jsonl"
+	logFile      = "wal.jsonl"
+)
+
+// DurableOptions 是 OpenDurableStorage 的参数
+type DurableOptions struct {
+	StorageOptions
+
+	// Dir 是快照和日志所在的目录, 不存在时会创建
+	Dir string
+
+	Sync SyncPolicy
+	// SyncInterval 为 0 时使用 DefaultSyncInterval
+	SyncInterval time.Duration
+
+	// SnapshotInterval 大于 0 时每隔这么长时间做一次快照, 快照完成后删除日志中已经在快照中的部分
+	SnapshotInterval time.Duration
+
+	// OnError 在后台的 Sync 和 Snapshot 失败, 以及 Delete 和 Clear 写日志失败时调用, 为 nil 时忽略这些错误
+	OnError func(error)
+}
+
+// DurableStorage 在内存中的 Storage 之外将每次修改追加到日志中, 并定期将所有数据写到快照,
+// 启动时从快照和日志中恢复数据
+//
+// 快照中只有 measurement 的当前版本和保留的历史版本, 恢复后 TTL 从恢复的时间开始计算.
+// 因为超过容量或 TTL 而被删除的 measurement 不会写到日志中, 恢复时它们会重新写入,
+// 再按 StorageOptions 淘汰
+//
+// 日志的第一行记录它的序号, 快照的第一行记录它包含了哪个日志的多少字节, 所以快照写完后
+// 崩溃时不会重复应用日志
+type DurableStorage struct {
+	Storage
+
+	opts DurableOptions
+
+	mu     sync.Mutex
+	log    *os.File
+	logSeq int64
+	writer *bufio.Writer
+	dirty  bool
+	closed bool
+
+	// snapshotMu 保证同时只有一个 Snapshot
+	snapshotMu sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// OpenDurableStorage 打开 opts.Dir 中的快照和日志, 恢复数据后返回 DurableStorage
+func OpenDurableStorage(opts DurableOptions) (*DurableStorage, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("dir of durable storage is empty")
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create dir '"+opts.Dir+"' fail")
+	}
+
+	ds := &DurableStorage{
+		Storage: NewStorageWithOptions(opts.StorageOptions),
+		opts:    opts,
+		done:    make(chan struct{}),
+	}
+	snapshot, _, err := ds.replay(filepath.Join(opts.Dir, snapshotFile), nil)
+	if err != nil {
+		return nil, err
+	}
+	header, valid, err := ds.replay(filepath.Join(opts.Dir, logFile), &snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := os.OpenFile(filepath.Join(opts.Dir, logFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open log of durable storage fail")
+	}
+	ds.log = log
+	ds.writer = bufio.NewWriter(log)
+	if err := ds.recoverLog(header, valid, snapshot.Seq); err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		ds.every(opts.SyncInterval, ds.Sync)
+	}
+	if opts.SnapshotInterval > 0 {
+		ds.every(opts.SnapshotInterval, ds.Snapshot)
+	}
+	return ds, nil
+}
+
+// recoverLog 删除写入时崩溃留下的不完整的行, 否则新的日志会接在它后面, 日志是空的时写入它的序号
+func (ds *DurableStorage) recoverLog(header logEntry, valid, snapshotSeq int64) error {
+	info, err := ds.log.Stat()
+	if err != nil {
+		return errors.Wrap(err, "read log of durable storage fail")
+	}
+	if info.Size() > valid {
+		if err := ds.log.Truncate(valid); err != nil {
+			return errors.Wrap(err, "truncate log of durable storage fail")
+		}
+		if err := ds.log.Sync(); err != nil {
+			return errors.Wrap(err, "sync log of durable storage fail")
+		}
+	}
+	if header.Op == opLog {
+		ds.logSeq = header.Seq
+		return nil
+	}
+	ds.logSeq = snapshotSeq + 1
+	if valid > 0 {
+		// 没有序号的旧日志, 序号只能写在第一行
+		return nil
+	}
+
+	bs, err := encodeEntry(logEntry{Op: opLog, Seq: ds.logSeq})
+	if err != nil {
+		return err
+	}
+	if _, err := ds.log.Write(bs); err != nil {
+		return errors.Wrap(err, "write log fail")
+	}
+	if err := ds.log.Sync(); err != nil {
+		return errors.Wrap(err, "sync log fail")
+	}
+	return nil
+}
+
+func (ds *DurableStorage) every(interval time.Duration, fn func() error) {
+	ds.wg.Add(1)
+	go func() {
+		defer ds.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ds.done:
+				return
+			case <-ticker.C:
+				if err := fn(); err != nil {
+					ds.reportError(err)
+				}
+			}
+		}
+	}()
+}
+
+// reportError 将不能返回给调用者的错误交给 OnError
+func (ds *DurableStorage) reportError(err error) {
+	if ds.opts.OnError != nil {
+		ds.opts.OnError(err)
+	}
+}
+
+func (ds *DurableStorage) Set(name string, tags []KeyValue, isSingleValue bool, t time.Time, table Table, err error) error {
+	// 日志中记录按表结构转换后的数据, 恢复时不需要先注册表结构
+	if schema, ok := ds.Schema(name); ok && err == nil {
+		converted, e := schema.Check(tags, table)
+		if e != nil {
+			return errors.Wrap(e, "table '"+name+"' is invalid")
+		}
+		table = converted
+	}
+
+	// 先序列化, 不能写到日志中的数据不能写到内存中, 否则快照也会失败
+	entry, e := newSetEntry(name, tags, isSingleValue, t, table, err)
+	if e != nil {
+		return errors.Wrap(e, "table '"+name+"' couldn't be saved")
+	}
+	bs, e := encodeEntry(entry)
+	if e != nil {
+		return e
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return errors.New("durable storage is closed")
+	}
+	if e := ds.Storage.Set(name, tags, isSingleValue, t, table, err); e != nil {
+		return e
+	}
+	return ds.write(bs)
+}
+
+// Delete 和 Clear 先写日志再修改内存, 写日志失败时不修改内存, 错误交给 OnError.
+// 重放时删除不存在的数据没有影响, 所以不需要先检查数据是否存在
+
+func (ds *DurableStorage) Delete(tablename string, tags []KeyValue) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if err := ds.append(logEntry{Op: opDelete, Table: tablename, Tags: tags}); err != nil {
+		ds.reportError(errors.Wrap(err, "delete '"+tablename+"' fail"))
+		return false
+	}
+	return ds.Storage.Delete(tablename, tags)
+}
+
+func (ds *DurableStorage) Clear(tablename string) int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if err := ds.append(logEntry{Op: opClear, Table: tablename}); err != nil {
+		ds.reportError(errors.Wrap(err, "clear '"+tablename+"' fail"))
+		return 0
+	}
+	return ds.Storage.Clear(tablename)
+}
+
+// SetSchema 注册表结构, 表结构不会保存到快照和日志中, 打开后需要重新注册
+func (ds *DurableStorage) SetSchema(tablename string, schema *Schema) error {
+	if s, ok := ds.Storage.(SchemaStorage); ok {
+		return s.SetSchema(tablename, schema)
+	}
+	return errors.New("storage isn't support schema")
+}
+
+func (ds *DurableStorage) Schema(tablename string) (*Schema, bool) {
+	if s, ok := ds.Storage.(SchemaStorage); ok {
+		return s.Schema(tablename)
+	}
+	return nil, false
+}
+
+func (ds *DurableStorage) Stats() StorageStats {
+	if s, ok := ds.Storage.(StatsStorage); ok {
+		return s.Stats()
+	}
+	return StorageStats{}
+}
+
+// append 将 entry 写到日志中, 调用者必须持有 ds.mu
+func (ds *DurableStorage) append(entry logEntry) error {
+	bs, err := encodeEntry(entry)
+	if err != nil {
+		return err
+	}
+	return ds.write(bs)
+}
+
+func encodeEntry(entry logEntry) ([]byte, error) {
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal log entry fail")
+	}
+	return append(bs, '\n'), nil
+}
+
+// write 将序列化后的一行写到日志中, 调用者必须持有 ds.mu
+func (ds *DurableStorage) write(bs []byte) error {
+	if ds.closed {
+		return errors.New("durable storage is closed")
+	}
+	if _, err := ds.writer.Write(bs); err != nil {
+		return errors.Wrap(err, "write log fail")
+	}
+	ds.dirty = true
+
+	switch ds.opts.Sync {
+	case SyncAlways:
+		return ds.sync()
+	case SyncNever:
+		// 写到操作系统, 进程崩溃时不会丢失
+		return ds.writer.Flush()
+	}
+	return nil
+}
+
+// Sync 将日志 fsync 到磁盘
+func (ds *DurableStorage) Sync() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return nil
+	}
+	return ds.sync()
+}
+
+func (ds *DurableStorage) sync() error {
+	if !ds.dirty {
+		return nil
+	}
+	if err := ds.writer.Flush(); err != nil {
+		return errors.Wrap(err, "flush log fail")
+	}
+	if ds.opts.Sync != SyncNever {
+		if err := ds.log.Sync(); err != nil {
+			return errors.Wrap(err, "sync log fail")
+		}
+	}
+	ds.dirty = false
+	return nil
+}
+
+// snapshotItem 是快照中一个 tag 集的所有版本
+type snapshotItem struct {
+	tablename string
+	current   Measurement
+	versions  []Measurement
+}
+
+// Snapshot 将所有数据写到快照中, 然后删除日志中已经在快照中的部分
+//
+// 它只在取得数据时持有写锁, Storage 中的数据写入后不会再修改, 所以序列化和写文件时
+// 其它的写操作可以继续, 它们会留在日志中
+func (ds *DurableStorage) Snapshot() error {
+	ds.snapshotMu.Lock()
+	defer ds.snapshotMu.Unlock()
+
+	ds.mu.Lock()
+	if ds.closed {
+		ds.mu.Unlock()
+		return errors.New("durable storage is closed")
+	}
+	if err := ds.writer.Flush(); err != nil {
+		ds.mu.Unlock()
+		return errors.Wrap(err, "flush log fail")
+	}
+	info, err := ds.log.Stat()
+	if err != nil {
+		ds.mu.Unlock()
+		return errors.Wrap(err, "read log of durable storage fail")
+	}
+	header := logEntry{Op: opSnapshot, Seq: ds.logSeq, Offset: info.Size()}
+	items, err := ds.snapshotItems()
+	ds.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := ds.writeSnapshotFile(header, items); err != nil {
+		return err
+	}
+	return ds.compactLog(header)
+}
+
+// snapshotItems 取得所有表的当前版本和历史版本, 调用者必须持有 ds.mu
+func (ds *DurableStorage) snapshotItems() ([]snapshotItem, error) {
+	all := func(TableName) (bool, error) { return true, nil }
+
+	var items []snapshotItem
+	for _, tablename := range ds.Storage.Tables() {
+		list, err := ds.Storage.From(tablename, all)
+		if err != nil {
+			if errors.Is(err, errors.ErrTableNotExists) {
+				continue
+			}
+			return nil, err
+		}
+		for _, m := range list {
+			tagsList := [][]KeyValue{m.Name.Tags}
+			if len(m.Name.Tags) == 0 {
+				tagsList = nil
+			}
+			key := m.Name.Tags.ToKey()
+			versions, err := ds.Storage.Versions(tablename, tagsList, func(name TableName) (bool, error) {
+				return name.Tags.ToKey() == key, nil
+			}, time.Time{}, time.Time{})
+			if err != nil && !errors.Is(err, errors.ErrTableNotExists) {
+				return nil, err
+			}
+			items = append(items, snapshotItem{tablename: tablename, current: m, versions: versions})
+		}
+	}
+	return items, nil
+}
+
+func (ds *DurableStorage) writeSnapshotFile(header logEntry, items []snapshotItem) error {
+	tmpname := filepath.Join(ds.opts.Dir, snapshotFile+".tmp")
+	out, err := os.Create(tmpname)
+	if err != nil {
+		return errors.Wrap(err, "create snapshot fail")
+	}
+	defer os.Remove(tmpname)
+
+	if err := writeSnapshot(out, header, items); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return errors.Wrap(err, "sync snapshot fail")
+	}
+	if err := out.Close(); err != nil {
+		return errors.Wrap(err, "close snapshot fail")
+	}
+	if err := os.Rename(tmpname, filepath.Join(ds.opts.Dir, snapshotFile)); err != nil {
+		return errors.Wrap(err, "rename snapshot fail")
+	}
+	return nil
+}
+
+// writeSnapshot 先写出 header, 然后按时间从旧到新写出每个 tag 集的所有版本, 重放时 Set 会重建历史版本
+func writeSnapshot(out io.Writer, header logEntry, items []snapshotItem) error {
+	writer := bufio.NewWriter(out)
+	encoder := json.NewEncoder(writer)
+	if err := encoder.Encode(header); err != nil {
+		return errors.Wrap(err, "write snapshot fail")
+	}
+	for _, item := range items {
+		for _, version := range item.versions {
+			entry, err := newSetEntry(item.tablename, version.Name.Tags, version.IsSingleValue, version.Time, version.Data, nil)
+			if err != nil {
+				return errors.Wrap(err, "write snapshot fail")
+			}
+			if err := encoder.Encode(entry); err != nil {
+				return errors.Wrap(err, "write snapshot fail")
+			}
+		}
+		if m := item.current; m.Err != nil {
+			entry, _ := newSetEntry(item.tablename, m.Name.Tags, m.IsSingleValue, m.ErrTime, Table{}, m.Err)
+			if err := encoder.Encode(entry); err != nil {
+				return errors.Wrap(err, "write snapshot fail")
+			}
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return errors.Wrap(err, "write snapshot fail")
+	}
+	return nil
+}
+
+// compactLog 将日志中快照之后写入的部分复制到新的日志中, 新的日志的序号加 1.
+// 崩溃时如果还是旧的日志, 重放时按快照中记录的位置跳过已经在快照中的部分
+func (ds *DurableStorage) compactLog(header logEntry) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.closed {
+		return errors.New("durable storage is closed")
+	}
+	if err := ds.writer.Flush(); err != nil {
+		return errors.Wrap(err, "flush log fail")
+	}
+
+	logname := filepath.Join(ds.opts.Dir, logFile)
+	in, err := os.Open(logname)
+	if err != nil {
+		return errors.Wrap(err, "open log fail")
+	}
+	defer in.Close()
+	if _, err := in.Seek(header.Offset, io.SeekStart); err != nil {
+		return errors.Wrap(err, "read log fail")
+	}
+
+	tmpname := logname + ".tmp"
+	out, err := os.Create(tmpname)
+	if err != nil {
+		return errors.Wrap(err, "create log fail")
+	}
+	defer os.Remove(tmpname)
+
+	bs, err := encodeEntry(logEntry{Op: opLog, Seq: header.Seq + 1})
+	if err == nil {
+		_, err = out.Write(bs)
+	}
+	if err == nil {
+		_, err = io.Copy(out, in)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return errors.Wrap(err, "write log fail")
+	}
+	if err := os.Rename(tmpname, logname); err != nil {
+		return errors.Wrap(err, "rename log fail")
+	}
+
+	log, err := os.OpenFile(logname, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open log of durable storage fail")
+	}
+	ds.log.Close()
+	ds.log = log
+	ds.logSeq = header.Seq + 1
+	ds.writer.Reset(log)
+	ds.dirty = false
+	return nil
+}
+
+// replay 将文件中的修改重新应用到内存中, 返回文件的第一行和最后一个完整的行之后的位置.
+// 没有换行符的最后一行是写入时崩溃留下的, 忽略它.
+//
+// snapshot 不为 nil 时文件是日志, 日志中已经在快照中的部分不会被应用
+func (ds *DurableStorage) replay(filename string, snapshot *logEntry) (logEntry, int64, error) {
+	var header logEntry
+	bs, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return header, 0, nil
+		}
+		return header, 0, errors.Wrap(err, "read '"+filename+"' fail")
+	}
+
+	var skip, valid int64
+	lines := bytes.Split(bs, []byte("\n"))
+	for idx, line := range lines {
+		if idx == len(lines)-1 {
+			break
+		}
+		offset := valid
+		valid += int64(len(line)) + 1
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry logEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return header, 0, errors.Wrap(err, "read '"+filename+"' fail, line "+strconv.Itoa(idx+1)+" is invalid")
+		}
+		if idx == 0 && (entry.Op == opLog || entry.Op == opSnapshot) {
+			header = entry
+			if snapshot != nil && snapshot.Op == opSnapshot {
+				if entry.Seq < snapshot.Seq {
+					skip = int64(len(bs))
+				} else if entry.Seq == snapshot.Seq {
+					skip = snapshot.Offset
+				}
+			}
+			continue
+		}
+		if offset < skip {
+			continue
+		}
+		if err := entry.apply(ds.Storage); err != nil {
+			return header, 0, errors.Wrap(err, "read '"+filename+"' fail, line "+strconv.Itoa(idx+1)+" is invalid")
+		}
+	}
+	return header, valid, nil
+}
+
+// Close 停止后台任务, 将日志写到磁盘后关闭它
+func (ds *DurableStorage) Close() error {
+	ds.mu.Lock()
+	if ds.closed {
+		ds.mu.Unlock()
+		return nil
+	}
+	err := ds.sync()
+	ds.closed = true
+	ds.mu.Unlock()
+
+	close(ds.done)
+	ds.wg.Wait()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if e := ds.log.Close(); e != nil && err == nil {
+		err = errors.Wrap(e, "close log fail")
+	}
+	return err
+}
+
+const (
+	opSet    = "set"
+	opDelete = "delete"
+	opClear  = "clear"
+	// opLog 是日志的第一行, Seq 是日志的序号
+	opLog = "log"
+	// opSnapshot 是快照的第一行, 快照包含了序号为 Seq 的日志的前 Offset 个字节
+	opSnapshot = "snapshot"
+)
+
+type logEntry struct {
+	Op      string       `json:"op"`
+	Table   string       `json:"table"`
+	Tags    []KeyValue   `json:"tags,omitempty"`
+	Single  bool         `json:"single,omitempty"`
+	Time    time.Time    `json:"time"`
+	Columns []string     `json:"columns,omitempty"`
+	Records [][]logValue `json:"records,omitempty"`
+	Err     string       `json:"err,omitempty"`
+	Seq     int64        `json:"seq,omitempty"`
+	Offset  int64        `json:"offset,omitempty"`
+}
+
+// logValue 是 Value 在日志中的形式, 类型为 any 的值不能还原, 所以不能保存
+type logValue struct {
+	Type  vm.ValueType `json:"t"`
+	Str   string       `json:"s,omitempty"`
+	Int   int64        `json:"i,omitempty"`
+	Float float64      `json:"f,omitempty"`
+	// NaN 和 ±Inf 不能序列化为 json, 它们保存在 Special 中, 值为 "NaN", "+Inf" 或 "-Inf"
+	Special string `json:"x,omitempty"`
+}
+
+func newSetEntry(name string, tags []KeyValue, isSingleValue bool, t time.Time, table Table, err error) (logEntry, error) {
+	entry := logEntry{
+		Op:     opSet,
+		Table:  name,
+		Tags:   tags,
+		Single: isSingleValue,
+		Time:   t,
+	}
+	if err != nil {
+		entry.Err = err.Error()
+		return entry, nil
+	}
+
+	columns, records, e := encodeTable(table)
+	if e != nil {
+		return logEntry{}, e
+	}
+	entry.Columns, entry.Records = columns, records
+	return entry, nil
+}
+
+// encodeTable 将 table 转换为可以序列化为 json 的形式
+func encodeTable(table Table) ([]string, [][]logValue, error) {
+	columns := make([]string, len(table.Columns))
+	for idx := range table.Columns {
+		columns[idx] = table.Columns[idx].Name
+	}
+	records := make([][]logValue, len(table.Records))
+	for i, record := range table.Records {
+		values := make([]logValue, len(record))
+		for j, value := range record {
+			if value.Type == vm.ValueAny {
+				return nil, nil, errors.New("value with index is '" + strconv.Itoa(i) + "' and column is '" + columnName(columns, j) + "' is of type any, couldn't be saved")
+			}
+			values[j] = logValue{
+				Type: value.Type,
+				Str:  value.Str,
+				Int:  value.Int64,
+			}
+			if math.IsNaN(value.Float64) || math.IsInf(value.Float64, 0) {
+				values[j].Special = strconv.FormatFloat(value.Float64, 'g', -1, 64)
+			} else {
+				values[j].Float = value.Float64
+			}
+		}
+		records[i] = values
+	}
+	return columns, records, nil
+}
+
+func columnName(columns []string, idx int) string {
+	if idx < len(columns) {
+		return columns[idx]
+	}
+	return strconv.Itoa(idx)
+}
+
+// decodeTable 是 encodeTable 的逆操作
+func decodeTable(columns []string, records [][]logValue) Table {
+	var table Table
+	table.Columns = make([]Column, len(columns))
+	for idx := range columns {
+		table.Columns[idx] = Column{Name: columns[idx]}
+	}
+	table.Records = make([][]Value, len(records))
+	for i, values := range records {
+		record := make([]Value, len(values))
+		for j, value := range values {
+			record[j] = Value{
+				Type:    value.Type,
+				Str:     value.Str,
+				Int64:   value.Int,
+				Float64: value.Float,
+			}
+			if value.Special != "" {
+				record[j].Float64, _ = strconv.ParseFloat(value.Special, 64)
+			}
+		}
+		table.Records[i] = record
+	}
+	return table
+}
+
+func (entry *logEntry) apply(s Storage) error {
+	switch entry.Op {
+	case opSet:
+		if entry.Err != "" {
+			return s.Set(entry.Table, entry.Tags, entry.Single, entry.Time, Table{}, errors.New(entry.Err))
+		}
+
+		table := decodeTable(entry.Columns, entry.Records)
+		return s.Set(entry.Table, entry.Tags, entry.Single, entry.Time, table, nil)
+	case opDelete:
+		s.Delete(entry.Table, entry.Tags)
+		return nil
+	case opClear:
+		s.Clear(entry.Table)
+		return nil
+	case opLog, opSnapshot:
+		return nil
+	default:
+		return errors.New("unknown op '" + entry.Op + "'")
+	}
+}
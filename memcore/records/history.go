@@ -0,0 +1,98 @@
+package records
+
+import (
+	"sort"
+	"time"
+)
+
+// HistoryPolicy 决定 storage 为每个 measurement 保留多少历史版本, 两个字段都为 0 时不保留
+type HistoryPolicy struct {
+	// MaxVersions 大于 0 时最多保留这么多个历史版本(不包括当前版本)
+	MaxVersions int
+	// MaxAge 大于 0 时只保留比最新版本早不超过 MaxAge 的历史版本
+	MaxAge time.Duration
+}
+
+func (p HistoryPolicy) enabled() bool {
+	return p.MaxVersions > 0 || p.MaxAge > 0
+}
+
+// addVersion 将 old 加入历史版本, t 是最新版本的时间, 调用者必须持有 s.mu 和 table.mu 的写锁
+func (s *storage) addVersion(table *memTable, key string, old Measurement, t time.Time) {
+	if !s.history.enabled() {
+		return
+	}
+
+	list := table.versions[key]
+	if !old.Time.IsZero() {
+		// 历史版本是成功读取的数据, 它之后的错误与它无关
+		old.ErrTime = time.Time{}
+		old.Err = nil
+		list = insertVersion(list, old)
+	}
+
+	if s.history.MaxAge > 0 {
+		limit := t.Add(-s.history.MaxAge)
+		offset := 0
+		for offset < len(list) && list[offset].Time.Before(limit) {
+			offset++
+		}
+		list = list[offset:]
+	}
+	if s.history.MaxVersions > 0 && len(list) > s.history.MaxVersions {
+		list = list[len(list)-s.history.MaxVersions:]
+	}
+
+	if len(list) == 0 {
+		delete(table.versions, key)
+		return
+	}
+	// 复制一份, 读操作可能仍然在使用原来的切片
+	table.versions[key] = append([]Measurement(nil), list...)
+}
+
+// insertVersion 将 m 按时间顺序插入 list 中, 同一时间的版本会被替换, 返回的是新的切片
+func insertVersion(list []Measurement, m Measurement) []Measurement {
+	idx := sort.Search(len(list), func(i int) bool {
+		return !list[i].Time.Before(m.Time)
+	})
+	results := make([]Measurement, 0, len(list)+1)
+	results = append(results, list[:idx]...)
+	results = append(results, m)
+	if idx < len(list) && list[idx].Time.Equal(m.Time) {
+		idx++
+	}
+	return append(results, list[idx:]...)
+}
+
+func (s *storage) Versions(tablename string, tagsList [][]KeyValue, filter func(name TableName) (bool, error), begin, end time.Time) ([]Measurement, error) {
+	list, versions, err := s.fromTags(tablename, tagsList, filter, true)
+	if err != nil {
+		return nil, err
+	}
+
+	inRange := func(t time.Time) bool {
+		if t.IsZero() || t.Before(begin) {
+			return false
+		}
+		return end.IsZero() || !t.After(end)
+	}
+
+	var results []Measurement
+	for idx, m := range list {
+		for _, version := range versions[idx] {
+			if inRange(version.Time) {
+				results = append(results, version)
+			}
+		}
+		if inRange(m.Time) {
+			m.ErrTime = time.Time{}
+			m.Err = nil
+			results = append(results, m)
+		}
+	}
+	if len(results) == 0 {
+		return nil, TableNotExists(tablename)
+	}
+	return results, nil
+}
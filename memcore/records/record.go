@@ -5,6 +5,7 @@ import (
 	"io"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/runner-mei/errors"
 	"github.com/runner-mei/memsql/vm"
@@ -69,6 +70,53 @@ type Record struct {
 	Tags    KeyValues
 	Columns []Column
 	Values  []Value
+
+	// Meta 是记录所属 measurement 的信息, 用于读取 @_time, @_err 和 @_table 这些伪列
+	Meta *RecordMeta
+}
+
+// 伪列的名称
+const (
+	PseudoTime  = "@_time"
+	PseudoErr   = "@_err"
+	PseudoTable = "@_table"
+)
+
+// IsPseudoColumn 判断 name 是不是伪列, 伪列不是 tag
+func IsPseudoColumn(name string) bool {
+	switch name {
+	case PseudoTime, PseudoErr, PseudoTable:
+		return true
+	}
+	return false
+}
+
+// RecordMeta 是记录所属 measurement 的信息
+type RecordMeta struct {
+	Table string
+	Time  time.Time
+	Err   error
+}
+
+func (meta *RecordMeta) get(name string) (Value, bool) {
+	if meta == nil {
+		return vm.Null(), false
+	}
+	switch name {
+	case PseudoTime:
+		if meta.Time.IsZero() {
+			return vm.Null(), true
+		}
+		return vm.DatetimeToValue(meta.Time), true
+	case PseudoErr:
+		if meta.Err == nil {
+			return vm.Null(), true
+		}
+		return vm.StringToValue(meta.Err.Error()), true
+	case PseudoTable:
+		return vm.StringToValue(meta.Table), true
+	}
+	return vm.Null(), false
 }
 
 func (r Record) GoString() string {
@@ -125,6 +173,7 @@ func (r *Record) Clone() Record {
 		Tags:    tags,
 		Columns: columns,
 		Values:  values,
+		Meta:    r.Meta,
 	}
 }
 
@@ -155,7 +204,7 @@ func (r *Record) At(idx int) Value {
 			return vm.StringToValue(r.Tags[idx].Value)
 		}
 	}
-	// Columns 和 Values 的长度不一定一致, 看下面的 ToTable
+	// Columns 和 Values 的长度不一定一致, 例如直接构造的 Table
 	return vm.Null()
 }
 
@@ -163,11 +212,14 @@ func (r *Record) Get(name string) (Value, bool) {
 	idx := columnSearchByName(r.Columns, name)
 	if idx >= 0 {
 		if len(r.Values) <= idx {
-			// Columns 和 Values 的长度不一定一致, 看下面的 ToTable
+			// Columns 和 Values 的长度不一定一致, 例如直接构造的 Table
 			return vm.Null(), true
 		}
 		return r.Values[idx], true
 	}
+	if IsPseudoColumn(name) {
+		return r.Meta.get(name)
+	}
 
 	if strings.HasPrefix(name, "@") {
 		name = strings.TrimPrefix(name, "@")
@@ -184,11 +236,14 @@ func (r *Record) GetByQualifierName(tableAs, name string) (Value, bool) {
 	idx := columnSearchByQualifierName(r.Columns, tableAs, name)
 	if idx >= 0 {
 		if len(r.Values) <= idx {
-			// Columns 和 Values 的长度不一定一致, 看下面的 ToTable
+			// Columns 和 Values 的长度不一定一致, 例如直接构造的 Table
 			return vm.Null(), true
 		}
 		return r.Values[idx], true
 	}
+	if IsPseudoColumn(name) {
+		return r.Meta.get(name)
+	}
 
 	if strings.HasPrefix(name, "@") {
 		name = strings.TrimPrefix(name, "@")
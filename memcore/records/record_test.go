@@ -1,13 +1,23 @@
 package records
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/runner-mei/memsql/vm"
 )
 
@@ -208,3 +218,865 @@ func TestMergeRecord(t *testing.T) {
 		t.Error(txt)
 	}
 }
+
+func TestStorageFromTags(t *testing.T) {
+	s := NewStorage()
+	for _, tags := range [][]KeyValue{
+		{{Key: "mo", Value: "1"}, {Key: "if", Value: "1"}},
+		{{Key: "mo", Value: "1"}, {Key: "if", Value: "2"}},
+		{{Key: "mo", Value: "2"}, {Key: "if", Value: "1"}},
+		{{Key: "mo", Value: "3"}},
+	} {
+		s.Set("cpu", tags, false, time.Now(), Table{}, nil)
+	}
+	// 重复的 Set 不会让索引中出现重复的 measurement
+	s.Set("cpu", []KeyValue{{Key: "if", Value: "1"}, {Key: "mo", Value: "1"}}, false, time.Now(), Table{}, nil)
+
+	var filtered int
+	all := func(name TableName) (bool, error) {
+		filtered++
+		return true, nil
+	}
+
+	for _, test := range []struct {
+		tagsList [][]KeyValue
+		want     []string
+		filtered int
+	}{
+		{tagsList: nil, want: []string{"if=1,mo=1", "if=1,mo=2", "if=2,mo=1", "mo=3"}, filtered: 4},
+		{tagsList: [][]KeyValue{{{Key: "mo", Value: "1"}}}, want: []string{"if=1,mo=1", "if=2,mo=1"}, filtered: 2},
+		{tagsList: [][]KeyValue{{{Key: "mo", Value: "1"}, {Key: "if", Value: "2"}}}, want: []string{"if=2,mo=1"}, filtered: 1},
+		{tagsList: [][]KeyValue{{{Key: "mo", Value: "3"}}, {{Key: "if", Value: "1"}}}, want: []string{"if=1,mo=1", "if=1,mo=2", "mo=3"}, filtered: 3},
+		{tagsList: [][]KeyValue{{{Key: "mo", Value: "9"}}}, want: nil, filtered: 0},
+	} {
+		filtered = 0
+		list, err := s.FromTags("cpu", test.tagsList, all)
+		if test.want == nil {
+			if err == nil {
+				t.Error(test.tagsList, "want error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(test.tagsList, err)
+			continue
+		}
+
+		var got []string
+		for _, m := range list {
+			got = append(got, m.Name.Tags.ToKey())
+		}
+		sort.Strings(got)
+		assertEqual(t, test.want, got, fmt.Sprint(test.tagsList))
+		assertEqual(t, test.filtered, filtered, fmt.Sprint(test.tagsList), " filtered ")
+	}
+}
+
+func TestStorageCapacity(t *testing.T) {
+	now := time.Date(2026, 10, 1, 10, 0, 0, 0, time.Local)
+	s := NewStorageWithOptions(StorageOptions{
+		Capacity: CapacityPolicy{
+			MaxMeasurements:      3,
+			MaxTableMeasurements: 2,
+			TTL:                  10 * time.Minute,
+		},
+		Now: func() time.Time { return now },
+	})
+	tags := func(mo string) []KeyValue {
+		return []KeyValue{{Key: "mo", Value: mo}}
+	}
+	keys := func(tablename string) []string {
+		list, _ := s.From(tablename, func(TableName) (bool, error) { return true, nil })
+		var got []string
+		for _, m := range list {
+			got = append(got, m.Name.Tags.ToKey())
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	s.Set("cpu", tags("1"), false, now, Table{}, nil)
+	s.Set("cpu", tags("2"), false, now, Table{}, nil)
+	// 访问 mo=1 后, 最久没有访问的是 mo=2
+	if !s.Exists("cpu", tags("1"), now.Add(-time.Minute), now) {
+		t.Error("mo=1 isnot exists")
+	}
+	s.Set("cpu", tags("3"), false, now, Table{}, nil)
+	// 超过表的限制, 淘汰 cpu 中的 mo=2
+	s.Set("mem", tags("1"), false, now, Table{}, nil)
+	s.Set("mem", tags("2"), false, now, Table{}, nil)
+	// 超过总数的限制, 淘汰所有表中最久没有访问的 cpu 中的 mo=1
+	assertEqual(t, []string{"mo=3"}, keys("cpu"), "limit")
+	assertEqual(t, []string{"mo=1", "mo=2"}, keys("mem"), "limit")
+
+	now = now.Add(5 * time.Minute)
+	s.Set("mem", tags("2"), false, now, Table{}, nil)
+	now = now.Add(6 * time.Minute)
+	if s.Exists("mem", tags("1"), time.Time{}, time.Time{}) {
+		t.Error("mo=1 is expired")
+	}
+	assertEqual(t, []string{"mo=2"}, keys("mem"), "ttl")
+	assertEqual(t, []string(nil), keys("cpu"), "ttl")
+
+	stats := s.(StatsStorage).Stats()
+	assertEqual(t, 1, stats.Measurements, "measurements")
+	assertEqual(t, 1, stats.Tables["mem"].Measurements, "mem measurements")
+	assertEqual(t, uint64(1), stats.Hits, "hits")
+	assertEqual(t, uint64(1), stats.Misses, "misses")
+	assertEqual(t, uint64(2), stats.Evictions, "evictions")
+	assertEqual(t, uint64(2), stats.Expirations, "expirations")
+	if stats.Bytes <= 0 || stats.Bytes != stats.Tables["mem"].Bytes {
+		t.Error("bytes is invalid", stats.Bytes, stats.Tables)
+	}
+}
+
+func TestStorageConcurrency(t *testing.T) {
+	s := NewStorageWithOptions(StorageOptions{
+		History:  HistoryPolicy{MaxVersions: 2},
+		Capacity: CapacityPolicy{MaxTableMeasurements: 8},
+	})
+	all := func(TableName) (bool, error) { return true, nil }
+	table := func(value int64) Table {
+		return Table{Columns: []Column{{Name: "v"}}, Records: [][]Value{{vm.IntToValue(value)}}}
+	}
+
+	// filter 在锁外调用, 所以在 filter 中写入不会死锁
+	s.Set("cpu", []KeyValue{{Key: "mo", Value: "0"}}, false, time.Now(), table(0), nil)
+	_, err := s.From("cpu", func(name TableName) (bool, error) {
+		return true, s.Set("cpu", []KeyValue{{Key: "mo", Value: "x"}}, false, time.Now(), table(0), nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				mo := strconv.Itoa((w*200 + i) % 16)
+				s.Set("cpu", []KeyValue{{Key: "mo", Value: mo}}, false, time.Unix(int64(i), 0), table(int64(i)), nil)
+				if i%50 == 0 {
+					s.Delete("cpu", []KeyValue{{Key: "mo", Value: mo}})
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				list, err := s.FromTags("cpu", [][]KeyValue{{{Key: "mo", Value: strconv.Itoa(i % 16)}}}, all)
+				if err == nil && len(list) != 1 {
+					t.Error("want one measurement, got", len(list))
+				}
+				s.Versions("cpu", nil, all, time.Time{}, time.Time{})
+				s.Exists("cpu", []KeyValue{{Key: "mo", Value: "1"}}, time.Time{}, time.Time{})
+				s.TagSets("cpu")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 索引, usage 和计数器仍然一致
+	list, err := s.From("cpu", all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagSets, err := s.TagSets("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := s.(StatsStorage).Stats()
+	assertEqual(t, len(list), len(tagSets), "tag sets")
+	assertEqual(t, len(list), stats.Measurements, "measurements")
+	assertEqual(t, len(list), stats.Tables["cpu"].Measurements, "table measurements")
+	if len(list) > 8 {
+		t.Error("want at most 8 measurements, got", len(list))
+	}
+	for _, m := range list {
+		found, err := s.FromTags("cpu", [][]KeyValue{m.Name.Tags}, all)
+		if err != nil || len(found) != 1 {
+			t.Error(m.Name.Tags.ToKey(), "isnot indexed", err)
+		}
+	}
+}
+
+func TestStorageManagement(t *testing.T) {
+	s := NewStorageWithHistory(HistoryPolicy{MaxVersions: 2})
+	for _, tags := range [][]KeyValue{
+		{{Key: "mo", Value: "2"}, {Key: "if", Value: "1"}},
+		{{Key: "mo", Value: "1"}, {Key: "if", Value: "1"}},
+		{{Key: "mo", Value: "1"}},
+	} {
+		s.Set("cpu", tags, false, time.Now(), Table{}, nil)
+		s.Set("cpu", tags, false, time.Now(), Table{}, nil)
+	}
+	s.Set("mem", []KeyValue{{Key: "mo", Value: "1"}}, false, time.Now(), Table{}, nil)
+
+	assertEqual(t, []string{"cpu", "mem"}, s.Tables(), "tables")
+
+	tagSets, err := s.TagSets("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tags := range tagSets {
+		got = append(got, tags.ToKey())
+	}
+	assertEqual(t, []string{"if=1,mo=1", "if=1,mo=2", "mo=1"}, got, "tag sets")
+
+	if !s.Delete("cpu", []KeyValue{{Key: "if", Value: "1"}, {Key: "mo", Value: "1"}}) {
+		t.Error("want deleted")
+	}
+	if s.Delete("cpu", []KeyValue{{Key: "mo", Value: "1"}, {Key: "if", Value: "1"}}) {
+		t.Error("want not found")
+	}
+
+	all := func(name TableName) (bool, error) { return true, nil }
+	list, err := s.FromTags("cpu", [][]KeyValue{{{Key: "if", Value: "1"}}}, all)
+	if err != nil || len(list) != 1 || list[0].Name.Tags.ToKey() != "if=1,mo=2" {
+		t.Error("index isnot updated", list, err)
+	}
+	if _, err := s.Versions("cpu", [][]KeyValue{{{Key: "mo", Value: "1"}, {Key: "if", Value: "1"}}}, all, time.Time{}, time.Time{}); err == nil {
+		t.Error("versions isnot deleted")
+	}
+
+	assertEqual(t, 2, s.Clear("cpu"), "clear")
+	assertEqual(t, []string{"mem"}, s.Tables(), "tables")
+	if _, err := s.TagSets("cpu"); err == nil {
+		t.Error("want error")
+	}
+	if stats := s.(StatsStorage).Stats(); stats.Measurements != 1 {
+		t.Error("want 1 measurement, got", stats.Measurements)
+	}
+}
+
+func TestColumnar(t *testing.T) {
+	table := Table{
+		Columns: []Column{{Name: "a"}, {Name: "b"}, {Name: "c"}},
+		Records: [][]Value{
+			{vm.IntToValue(1), vm.StringToValue("x"), vm.FloatToValue(1.5)},
+			{vm.IntToValue(2), vm.IntToValue(3)}, // c 为 null
+			{vm.Null(), vm.StringToValue("z"), vm.FloatToValue(2.5)},
+		},
+	}
+	ct := ToColumnar(table)
+	assertEqual(t, 3, ct.Length(), "length")
+	assertEqual(t, vm.ValueInt64, ct.Vectors[0].Type, "type of a")
+	assertEqual(t, []int64{1, 2, 0}, ct.Vectors[0].Ints, "ints of a")
+	assertEqual(t, vm.ValueAny, ct.Vectors[1].Type, "type of b")
+	assertEqual(t, vm.ValueFloat64, ct.Vectors[2].Type, "type of c")
+	assertEqual(t, 2, ct.ColumnIndex("", "c"), "index of c")
+	assertEqual(t, -1, ct.ColumnIndex("t1", "c"), "index of t1.c")
+
+	for row := 0; row < table.Length(); row++ {
+		want := table.At(row)
+		got := ct.At(row)
+		for _, column := range table.Columns {
+			wantValue, _ := want.Get(column.Name)
+			gotValue, _ := got.Get(column.Name)
+			assertEqual(t, wantValue, gotValue, fmt.Sprint("row ", row, " column ", column.Name))
+		}
+	}
+
+	s := NewStorage()
+	s.Set("cpu", nil, false, time.Now(), table, nil)
+	list, err := s.From("cpu", func(TableName) (bool, error) { return true, nil })
+	if err != nil || len(list) != 1 {
+		t.Fatal(list, err)
+	}
+	if list[0].Data.Columnar() != list[0].Data.Columnar() {
+		t.Error("want columnar table is cached")
+	}
+	if list[0].Data.Columnar().Columns[0].TableName != "cpu" {
+		t.Error("want table name of columns")
+	}
+}
+
+func TestToTableWithSchema(t *testing.T) {
+	values := []map[string]interface{}{
+		{"c": 1, "a": "x"},
+		{"b": 2.5, "a": "y"},
+	}
+	columnNames := func(table Table) string {
+		var names []string
+		for _, column := range table.Columns {
+			names = append(names, column.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	for i := 0; i < 10; i++ {
+		table, err := ToTable(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, "a,b,c", columnNames(table), "columns")
+		for _, record := range table.Records {
+			assertEqual(t, 3, len(record), "length of record")
+		}
+		assertEqual(t, vm.Null(), table.Records[0][1], "missing value")
+	}
+
+	schema := &Schema{Columns: []ColumnSchema{{Name: "c", Type: vm.ValueFloat64}, {Name: "d"}, {Name: "b", Type: vm.ValueString}}}
+	table, err := ToTableWithSchema(values, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "c,d,b,a", columnNames(table), "columns")
+	assertEqual(t, vm.FloatToValue(1), table.Records[0][0], "converted c")
+	assertEqual(t, vm.Null(), table.Records[0][1], "missing d")
+	assertEqual(t, vm.StringToValue("2.5"), table.Records[1][2], "converted b")
+	assertEqual(t, vm.StringToValue("y"), table.Records[1][3], "a")
+
+	schema.Columns[0].Type = vm.ValueDatetime
+	if _, err := ToTableWithSchema(values, schema); err == nil {
+		t.Error("want error for converting int to datetime")
+	}
+
+	var added Table
+	added.Add([]Column{{Name: "a"}}, []Value{vm.IntToValue(1)})
+	added.Add([]Column{{Name: "b"}}, []Value{vm.IntToValue(2)})
+	assertEqual(t, [][]Value{{vm.IntToValue(1), vm.Null()}, {vm.Null(), vm.IntToValue(2)}}, added.Records, "records of Add")
+}
+
+func TestSchemaStorage(t *testing.T) {
+	s := NewStorage()
+	ss := s.(SchemaStorage)
+	if err := ss.SetSchema("cpu", &Schema{Columns: []ColumnSchema{{Name: "a"}, {Name: "a"}}}); err == nil {
+		t.Error("want error for duplicated column")
+	}
+	err := ss.SetSchema("cpu", &Schema{
+		Columns: []ColumnSchema{
+			{Name: "usage", Type: vm.ValueFloat64, NotNull: true},
+			{Name: "name", Type: vm.ValueString},
+		},
+		Tags:   []string{"mo"},
+		Strict: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := []KeyValue{{Key: "mo", Value: "1"}}
+	set := func(tags []KeyValue, columns []string, values ...Value) error {
+		table := Table{Records: [][]Value{values}}
+		for _, name := range columns {
+			table.Columns = append(table.Columns, Column{Name: name})
+		}
+		return s.Set("cpu", tags, false, time.Now(), table, nil)
+	}
+
+	if err := set(tags, []string{"name", "usage"}, vm.IntToValue(1), vm.IntToValue(2)); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.From("cpu", func(TableName) (bool, error) { return true, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, 1, len(list), "measurements")
+	assertEqual(t, "usage", list[0].Data.Columns[0].Name, "first column")
+	assertEqual(t, [][]Value{{vm.FloatToValue(2), vm.StringToValue("1")}}, list[0].Data.Records, "converted values")
+
+	for _, test := range []struct {
+		name    string
+		tags    []KeyValue
+		columns []string
+		values  []Value
+	}{
+		{name: "convert", tags: tags, columns: []string{"usage"}, values: []Value{vm.StringToValue("abc")}},
+		{name: "not null", tags: tags, columns: []string{"name"}, values: []Value{vm.StringToValue("a")}},
+		{name: "strict", tags: tags, columns: []string{"usage", "extra"}, values: []Value{vm.IntToValue(1), vm.IntToValue(1)}},
+		{name: "tags", tags: []KeyValue{{Key: "host", Value: "1"}}, columns: []string{"usage"}, values: []Value{vm.IntToValue(1)}},
+	} {
+		if err := set(test.tags, test.columns, test.values...); err == nil {
+			t.Error(test.name, ": want error")
+		}
+	}
+
+	// 读取出错时只检查 tag 集
+	if err := s.Set("cpu", tags, false, time.Now(), Table{}, errors.New("read fail")); err != nil {
+		t.Error(err)
+	}
+
+	if err := ss.SetSchema("cpu", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ss.Schema("cpu"); ok {
+		t.Error("want schema removed")
+	}
+	if err := set(tags, []string{"extra"}, vm.IntToValue(1)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDurableStorage(t *testing.T) {
+	dir := t.TempDir()
+	opts := DurableOptions{
+		StorageOptions: StorageOptions{History: HistoryPolicy{MaxVersions: 5}},
+		Dir:            dir,
+		Sync:           SyncAlways,
+	}
+	base := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	set := func(s Storage, mo string, minutes int, value int64) {
+		table := Table{
+			Columns: []Column{{Name: "value"}, {Name: "name"}},
+			Records: [][]Value{{vm.IntToValue(value), vm.StringToValue("mo" + mo)}},
+		}
+		if err := s.Set("cpu", []KeyValue{{Key: "mo", Value: mo}}, true, base.Add(time.Duration(minutes)*time.Minute), table, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := OpenDurableStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(s, "1", 0, 10)
+	set(s, "1", 1, 11)
+	set(s, "2", 0, 20)
+	set(s, "3", 0, 30)
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	set(s, "1", 2, 12)
+	s.Set("cpu", []KeyValue{{Key: "mo", Value: "2"}}, false, base.Add(3*time.Minute), Table{}, errors.New("mo 2 is down"))
+	s.Delete("cpu", []KeyValue{{Key: "mo", Value: "3"}})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟写入日志时崩溃, 最后一行不完整
+	log, err := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.WriteString(`{"op":"set","table":"cpu","ta`)
+	log.Close()
+
+	s, err = OpenDurableStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	all := func(TableName) (bool, error) { return true, nil }
+	list, err := s.From("cpu", all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, m := range list {
+		var sb strings.Builder
+		for _, record := range m.Data.Records {
+			for _, value := range record {
+				sb.WriteString(value.String())
+				sb.WriteString(";")
+			}
+		}
+		if m.Err != nil {
+			sb.WriteString(m.Err.Error())
+		}
+		got[m.Name.Tags.ToKey()] = sb.String()
+	}
+	assertEqual(t, map[string]string{
+		"mo=1": "12;mo1;",
+		"mo=2": "20;mo2;mo 2 is down",
+	}, got)
+
+	versions, err := s.Versions("cpu", [][]KeyValue{{{Key: "mo", Value: "1"}}}, all, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times []int
+	for _, m := range versions {
+		times = append(times, int(m.Time.Sub(base)/time.Minute))
+	}
+	assertEqual(t, []int{0, 1, 2}, times, "versions")
+
+	// 不完整的行被删除后, 新的日志可以正常恢复
+	set(s, "4", 4, 40)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenDurableStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	list, err = s.FromTags("cpu", [][]KeyValue{{{Key: "mo", Value: "4"}}}, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "40", list[0].Data.Records[0][0].String(), "mo=4")
+}
+
+func TestDurableStorageSnapshotCrash(t *testing.T) {
+	dir := t.TempDir()
+	var errs []error
+	opts := DurableOptions{
+		StorageOptions: StorageOptions{History: HistoryPolicy{MaxVersions: 5}},
+		Dir:            dir,
+		Sync:           SyncAlways,
+		OnError:        func(err error) { errs = append(errs, err) },
+	}
+	base := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	set := func(s Storage, minutes int) {
+		table := Table{
+			Columns: []Column{{Name: "value"}},
+			Records: [][]Value{{vm.IntToValue(int64(minutes))}},
+		}
+		if err := s.Set("cpu", []KeyValue{{Key: "mo", Value: "1"}}, true, base.Add(time.Duration(minutes)*time.Minute), table, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := OpenDurableStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(s, 0)
+	set(s, 1)
+
+	// 模拟快照写完后, 删除日志中已经在快照中的部分之前崩溃
+	s.mu.Lock()
+	s.writer.Flush()
+	info, err := s.log.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := logEntry{Op: opSnapshot, Seq: s.logSeq, Offset: info.Size()}
+	items, err := s.snapshotItems()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeSnapshotFile(header, items); err != nil {
+		t.Fatal(err)
+	}
+	set(s, 2)
+	s.Delete("cpu", []KeyValue{{Key: "mo", Value: "2"}})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 关闭后写日志失败, 内存中的数据不变
+	if s.Delete("cpu", []KeyValue{{Key: "mo", Value: "1"}}) {
+		t.Error("want delete fail after close")
+	}
+	if len(errs) != 1 {
+		t.Error("want 1 error, got", errs)
+	}
+
+	for i := 0; i < 2; i++ {
+		s, err = OpenDurableStorage(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions, err := s.Versions("cpu", nil, func(TableName) (bool, error) { return true, nil }, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var times []int
+		for _, m := range versions {
+			times = append(times, int(m.Time.Sub(base)/time.Minute))
+		}
+		assertEqual(t, []int{0, 1, 2}, times, "versions")
+
+		// 第二次打开时日志已经被压缩
+		if err := s.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDurableStorageSpecialValues(t *testing.T) {
+	dir := t.TempDir()
+	opts := DurableOptions{Dir: dir, Sync: SyncAlways}
+	base := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+
+	s, err := OpenDurableStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := Table{
+		Columns: []Column{{Name: "nan"}, {Name: "inf"}, {Name: "ninf"}},
+		Records: [][]Value{{vm.FloatToValue(math.NaN()), vm.FloatToValue(math.Inf(1)), vm.FloatToValue(math.Inf(-1))}},
+	}
+	if err := s.Set("cpu", []KeyValue{{Key: "mo", Value: "1"}}, true, base, table, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// any 类型的值不能保存, 写入失败时内存中的数据不变
+	table = Table{
+		Columns: []Column{{Name: "value"}},
+		Records: [][]Value{{vm.AnyToValue(struct{}{})}},
+	}
+	if err := s.Set("cpu", []KeyValue{{Key: "mo", Value: "2"}}, true, base, table, nil); err == nil {
+		t.Error("want error for value of type any")
+	}
+	if s.Exists("cpu", []KeyValue{{Key: "mo", Value: "2"}}, time.Time{}, time.Time{}) {
+		t.Error("mo=2 shouldnot be saved")
+	}
+
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenDurableStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	list, err := s.From("cpu", func(TableName) (bool, error) { return true, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || len(list[0].Data.Records) != 1 {
+		t.Fatal("want 1 record, got", list)
+	}
+	record := list[0].Data.Records[0]
+	if !math.IsNaN(record[0].Float64) || !math.IsInf(record[1].Float64, 1) || !math.IsInf(record[2].Float64, -1) {
+		t.Error("want NaN, +Inf and -Inf, got", record)
+	}
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "storage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewSQLiteStorage(conn, HistoryPolicy{MaxVersions: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	set := func(tags []KeyValue, minutes int, value string) {
+		table := Table{
+			Columns: []Column{{Name: "f1"}},
+			Records: [][]Value{{vm.StringToValue(value)}},
+		}
+		if err := s.Set("cpu", tags, false, base.Add(time.Duration(minutes)*time.Minute), table, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set([]KeyValue{{Key: "mo", Value: "1"}, {Key: "if", Value: "1"}}, 0, "a")
+	set([]KeyValue{{Key: "mo", Value: "1"}, {Key: "if", Value: "2"}}, 0, "b")
+	set([]KeyValue{{Key: "mo", Value: "2"}}, 0, "c")
+	set([]KeyValue{{Key: "if", Value: "1"}, {Key: "mo", Value: "1"}}, 1, "a1")
+	set([]KeyValue{{Key: "if", Value: "1"}, {Key: "mo", Value: "1"}}, 2, "a2")
+	s.Set("cpu", []KeyValue{{Key: "mo", Value: "2"}}, false, base.Add(3*time.Minute), Table{}, errors.New("mo 2 is down"))
+
+	all := func(name TableName) (bool, error) { return true, nil }
+	toLines := func(list []Measurement) []string {
+		var lines []string
+		for _, m := range list {
+			line := m.Name.Tags.ToKey() + ":"
+			for _, record := range m.Data.Records {
+				line += record[0].Str
+			}
+			if m.Err != nil {
+				line += ":" + m.Err.Error()
+			}
+			lines = append(lines, line)
+		}
+		sort.Strings(lines)
+		return lines
+	}
+
+	for _, test := range []struct {
+		tagsList [][]KeyValue
+		want     []string
+	}{
+		{tagsList: nil, want: []string{"if=1,mo=1:a2", "if=2,mo=1:b", "mo=2:c:mo 2 is down"}},
+		{tagsList: [][]KeyValue{{{Key: "mo", Value: "1"}}}, want: []string{"if=1,mo=1:a2", "if=2,mo=1:b"}},
+		{tagsList: [][]KeyValue{{{Key: "mo", Value: "2"}}, {{Key: "if", Value: "2"}}}, want: []string{"if=2,mo=1:b", "mo=2:c:mo 2 is down"}},
+		{tagsList: [][]KeyValue{{{Key: "mo", Value: "9"}}}, want: nil},
+		{tagsList: [][]KeyValue{{{Key: "unknown", Value: "9"}}}, want: nil},
+	} {
+		list, err := s.FromTags("cpu", test.tagsList, all)
+		if test.want == nil {
+			if err == nil {
+				t.Error(test.tagsList, "want error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(test.tagsList, err)
+			continue
+		}
+		assertEqual(t, test.want, toLines(list), fmt.Sprint(test.tagsList))
+	}
+
+	versions, err := s.Versions("cpu", [][]KeyValue{{{Key: "mo", Value: "1"}, {Key: "if", Value: "1"}}}, all, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []string{"if=1,mo=1:a1", "if=1,mo=1:a2"}, toLines(versions), "versions")
+
+	if !s.Exists("cpu", []KeyValue{{Key: "mo", Value: "2"}}, base.Add(time.Hour), base.Add(2*time.Minute)) {
+		t.Error("error of mo=2 is fresh")
+	}
+	if s.Exists("cpu", []KeyValue{{Key: "mo", Value: "1"}, {Key: "if", Value: "2"}}, base, base) {
+		t.Error("mo=1,if=2 is stale")
+	}
+
+	assertEqual(t, []string{"cpu"}, s.Tables(), "tables")
+	tagSets, err := s.TagSets("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []KeyValues{
+		{{Key: "if", Value: "1"}, {Key: "mo", Value: "1"}},
+		{{Key: "if", Value: "2"}, {Key: "mo", Value: "1"}},
+		{{Key: "mo", Value: "2"}},
+	}, tagSets, "tag sets")
+
+	if !s.Delete("cpu", []KeyValue{{Key: "mo", Value: "2"}}) {
+		t.Error("want deleted")
+	}
+	assertEqual(t, 2, s.Clear("cpu"), "clear")
+	assertEqual(t, []string(nil), s.Tables(), "tables")
+
+	// 重新打开后仍然可以读取
+	set([]KeyValue{{Key: "mo", Value: "3"}}, 0, "d")
+	s, err = NewSQLiteStorage(conn, HistoryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.From("cpu", all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []string{"mo=3:d"}, toLines(list), "reopen")
+}
+
+func TestSQLiteStorageSpecialNames(t *testing.T) {
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "storage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewSQLiteStorage(conn, HistoryPolicy{MaxVersions: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	table := Table{
+		Columns: []Column{{Name: "f1"}},
+		Records: [][]Value{{vm.FloatToValue(math.NaN())}},
+	}
+	for _, name := range []string{sqliteCatalog, "cpu"} {
+		if err := s.Set(name, []KeyValue{{Key: "mo", Value: "1"}}, false, base, table, nil); err != nil {
+			t.Fatal(name, err)
+		}
+	}
+	// SQLite 的标识符不区分大小写, 只有大小写不同的表名和 tag 名不能冲突
+	for _, name := range []string{"CPU", "cpu$versions", "cpu@host"} {
+		if err := s.Set(name, []KeyValue{{Key: "Host", Value: "a"}}, false, base, table, nil); err != nil {
+			t.Fatal(name, err)
+		}
+		if err := s.Set(name, []KeyValue{{Key: "host", Value: "b"}}, false, base, table, nil); err != nil {
+			t.Fatal(name, err)
+		}
+	}
+	assertEqual(t, []string{"CPU", "cpu", "cpu$versions", "cpu@host", sqliteCatalog}, s.Tables(), "tables")
+	assertEqual(t, 1, s.Clear("cpu"), "clear")
+	tagsList, err := s.TagSets("CPU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []KeyValues{{{Key: "Host", Value: "a"}}, {{Key: "host", Value: "b"}}}, tagsList, "tag sets")
+	list, err := s.FromTags("cpu@host", [][]KeyValue{{{Key: "host", Value: "b"}}}, func(TableName) (bool, error) { return true, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, KeyValues{{Key: "host", Value: "b"}}, list[0].Name.Tags, "from tags")
+	if err := s.Set("cpu", []KeyValue{{Key: "mo", Value: "1"}}, false, base, table, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// filter 中可以访问 Storage
+	list, err = s.FromTags("cpu", nil, func(name TableName) (bool, error) {
+		return s.Exists(sqliteCatalog, name.Tags, time.Time{}, time.Time{}), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || !math.IsNaN(list[0].Data.Records[0][0].Float64) {
+		t.Error("want NaN, got", list)
+	}
+}
+
+func TestStorageOlderSet(t *testing.T) {
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "storage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	newSQLite := func(policy HistoryPolicy) Storage {
+		s, err := NewSQLiteStorage(conn, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	base := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	all := func(TableName) (bool, error) { return true, nil }
+	for _, test := range []struct {
+		name     string
+		storage  Storage
+		current  string
+		versions []string
+	}{
+		{name: "memory", storage: NewStorageWithHistory(HistoryPolicy{MaxVersions: 5}), current: "3", versions: []string{"1", "2", "3"}},
+		{name: "memory without history", storage: NewStorage(), current: "3", versions: []string{"3"}},
+		{name: "sqlite", storage: newSQLite(HistoryPolicy{MaxVersions: 5}), current: "3", versions: []string{"1", "2", "3"}},
+	} {
+		tablename := strings.Replace(test.name, " ", "_", -1)
+		set := func(minutes int) {
+			table := Table{
+				Columns: []Column{{Name: "value"}},
+				Records: [][]Value{{vm.IntToValue(int64(minutes))}},
+			}
+			if err := test.storage.Set(tablename, nil, true, base.Add(time.Duration(minutes)*time.Minute), table, nil); err != nil {
+				t.Fatal(test.name, err)
+			}
+		}
+		// 乱序到达的旧数据只加入历史版本, 不替换当前数据
+		set(2)
+		set(1)
+		set(3)
+		set(1)
+
+		list, err := test.storage.From(tablename, all)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		assertEqual(t, test.current, list[0].Data.Records[0][0].String(), test.name, "current")
+
+		versions, err := test.storage.Versions(tablename, nil, all, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		var values []string
+		for _, m := range versions {
+			values = append(values, m.Data.Records[0][0].String())
+		}
+		assertEqual(t, test.versions, values, test.name, "versions")
+	}
+}
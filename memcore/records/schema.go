@@ -0,0 +1,347 @@
+package records
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/memsql/vm"
+)
+
+// Schema 是表的列定义, 按列的顺序排列
+type Schema struct {
+	Columns []ColumnSchema
+
+	// Tags 是 measurement 的 tag 名, 不为空时写入的 tag 集必须正好是这些 tag
+	Tags []string
+	// Strict 为 true 时不允许写入或查询 Columns 中没有的列
+	Strict bool
+}
+
+// ColumnSchema 是一列的定义, Type 为 ValueNull 时不限制值的类型
+type ColumnSchema struct {
+	Name string
+	Type vm.ValueType
+	// NotNull 为 true 时列的值不能为 null
+	NotNull bool
+}
+
+// NewSchema 返回由 names 组成的不限制类型的 Schema
+func NewSchema(names ...string) *Schema {
+	schema := &Schema{Columns: make([]ColumnSchema, len(names))}
+	for idx := range names {
+		schema.Columns[idx].Name = names[idx]
+	}
+	return schema
+}
+
+// Index 返回列的序号, 找不到时返回 -1
+func (schema *Schema) Index(name string) int {
+	for idx := range schema.Columns {
+		if schema.Columns[idx].Name == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Validate 检查 schema 本身是否正确, 列名和 tag 名不能为空或重复
+func (schema *Schema) Validate() error {
+	names := map[string]struct{}{}
+	for _, column := range schema.Columns {
+		if column.Name == "" {
+			return errors.New("column name is empty")
+		}
+		if _, ok := names[column.Name]; ok {
+			return errors.New("column '" + column.Name + "' is duplicated")
+		}
+		names[column.Name] = struct{}{}
+	}
+	tags := map[string]struct{}{}
+	for _, tag := range schema.Tags {
+		if tag == "" {
+			return errors.New("tag name is empty")
+		}
+		if _, ok := tags[tag]; ok {
+			return errors.New("tag '" + tag + "' is duplicated")
+		}
+		tags[tag] = struct{}{}
+	}
+	return nil
+}
+
+// HasTag 判断 name 是不是 schema 中声明的 tag
+func (schema *Schema) HasTag(name string) bool {
+	for _, tag := range schema.Tags {
+		if tag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Check 检查写入表中的 tag 集和数据, 返回按 schema 转换后的数据, 不符合时返回错误
+func (schema *Schema) Check(tags []KeyValue, table Table) (Table, error) {
+	if len(schema.Tags) > 0 {
+		keys := make([]string, len(tags))
+		for idx := range tags {
+			keys[idx] = tags[idx].Key
+		}
+		sort.Strings(keys)
+		expected := append([]string(nil), schema.Tags...)
+		sort.Strings(expected)
+		if !stringsEqual(keys, expected) {
+			return Table{}, errors.New("tags '" + KeyValues(tags).ToKey() + "' isn't match the declared tags '" + strings.Join(schema.Tags, ",") + "'")
+		}
+	}
+
+	if schema.Strict {
+		for _, column := range table.Columns {
+			if schema.Index(column.Name) < 0 {
+				return Table{}, errors.New("column '" + column.Name + "' isn't declared")
+			}
+		}
+	}
+
+	result, err := ApplySchema(table, schema)
+	if err != nil {
+		return Table{}, err
+	}
+
+	for idx, column := range schema.Columns {
+		if !column.NotNull {
+			continue
+		}
+		for row, record := range result.Records {
+			if record[idx].IsNil() {
+				return Table{}, errors.New("value with index is '" + strconv.Itoa(row) + "' and column is '" + column.Name + "' is null")
+			}
+		}
+	}
+	return result, nil
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplySchema 按 schema 重新排列 table 的列, schema 中的列在前面, 其它的列按原来的顺序排在后面,
+// 缺少的值为 null, 有类型的列会转换值的类型, schema 为 nil 时只补齐缺少的值
+func ApplySchema(table Table, schema *Schema) (Table, error) {
+	if schema == nil && isAligned(table) {
+		return table, nil
+	}
+
+	var columns []Column
+	var types []vm.ValueType
+	if schema != nil {
+		for _, column := range schema.Columns {
+			columns = append(columns, Column{Name: column.Name})
+			types = append(types, column.Type)
+		}
+	}
+	for _, column := range table.Columns {
+		if columnSearchByName(columns, column.Name) < 0 {
+			columns = append(columns, Column{Name: column.Name})
+			types = append(types, vm.ValueNull)
+		}
+	}
+
+	// 原来的列在新的列中的位置
+	positions := make([]int, len(table.Columns))
+	for idx, column := range table.Columns {
+		positions[idx] = columnSearchByName(columns, column.Name)
+	}
+
+	result := Table{
+		Columns: columns,
+		Records: make([][]Value, len(table.Records)),
+	}
+	for row, record := range table.Records {
+		values := make([]Value, len(columns))
+		for idx := range values {
+			values[idx] = vm.Null()
+		}
+		for idx, value := range record {
+			if idx >= len(positions) {
+				break
+			}
+			pos := positions[idx]
+			if types[pos] != vm.ValueNull {
+				converted, err := ConvertValue(value, types[pos])
+				if err != nil {
+					return Table{}, errors.Wrap(err, "value with index is '"+strconv.Itoa(row)+"' and column is '"+columns[pos].Name+"' is invalid")
+				}
+				value = converted
+			}
+			values[pos] = value
+		}
+		result.Records[row] = values
+	}
+	return result, nil
+}
+
+// isAligned 判断 table 的每一行是否都有所有的列
+func isAligned(table Table) bool {
+	for _, record := range table.Records {
+		if len(record) != len(table.Columns) {
+			return false
+		}
+	}
+	return true
+}
+
+// ToTableWithSchema 同 ToTable, 但按 schema 排列列并转换值的类型
+func ToTableWithSchema(values []map[string]interface{}, schema *Schema) (Table, error) {
+	table, err := ToTable(values)
+	if err != nil {
+		return table, err
+	}
+	return ApplySchema(table, schema)
+}
+
+// ConvertValue 将 value 转换为 typ 类型, null 不转换, 不能转换时返回错误
+func ConvertValue(value Value, typ vm.ValueType) (Value, error) {
+	if value.Type == typ || value.Type == vm.ValueNull || typ == vm.ValueNull || typ == vm.ValueAny {
+		return value, nil
+	}
+
+	read := func(vm.Context) (Value, error) {
+		return value, nil
+	}
+	switch typ {
+	case vm.ValueBool:
+		return vm.ConvertToBool(read)(nil)
+	case vm.ValueInt64:
+		if value.Type == vm.ValueFloat64 {
+			if value.Float64 != math.Trunc(value.Float64) {
+				return vm.Null(), convertError(value, typ)
+			}
+			return vm.IntToValue(int64(value.Float64)), nil
+		}
+		return vm.ConvertToInt(read)(nil)
+	case vm.ValueUint64:
+		if value.Type == vm.ValueInt64 && value.Int64 < 0 {
+			return vm.Null(), convertError(value, typ)
+		}
+		return vm.ConvertToUint(read)(nil)
+	case vm.ValueFloat64:
+		switch value.Type {
+		case vm.ValueInt64:
+			return vm.FloatToValue(float64(value.Int64)), nil
+		case vm.ValueUint64:
+			return vm.FloatToValue(float64(uint64(value.Int64))), nil
+		case vm.ValueString:
+			f64, err := strconv.ParseFloat(value.Str, 64)
+			if err != nil {
+				return vm.Null(), convertError(value, typ)
+			}
+			return vm.FloatToValue(f64), nil
+		}
+	case vm.ValueString:
+		switch value.Type {
+		case vm.ValueFloat64:
+			return vm.StringToValue(strconv.FormatFloat(value.Float64, 'g', -1, 64)), nil
+		case vm.ValueBool, vm.ValueInt64, vm.ValueUint64:
+			s, err := value.AsString(true)
+			if err != nil {
+				return vm.Null(), convertError(value, typ)
+			}
+			return vm.StringToValue(s), nil
+		case vm.ValueDatetime:
+			return vm.StringToValue(vm.IntToDatetime(value.Int64).Format(time.RFC3339Nano)), nil
+		case vm.ValueInterval:
+			return vm.StringToValue(vm.IntToInterval(value.Int64).String()), nil
+		}
+	case vm.ValueDatetime:
+		return vm.ConvertToDatetime(read)(nil)
+	case vm.ValueInterval:
+		switch value.Type {
+		case vm.ValueInt64:
+			return vm.IntervalToValue(time.Duration(value.Int64)), nil
+		case vm.ValueString:
+			d, err := time.ParseDuration(value.Str)
+			if err != nil {
+				return vm.Null(), convertError(value, typ)
+			}
+			return vm.IntervalToValue(d), nil
+		}
+	}
+	return vm.Null(), convertError(value, typ)
+}
+
+func convertError(value Value, typ vm.ValueType) error {
+	return errors.New("couldn't convert '" + value.String() + "' of type " + value.Type.String() + " to " + typ.String())
+}
+
+// SchemaStorage 是可以注册表结构的 Storage, 注册后 Set 会按表结构转换数据, 不符合时拒绝写入
+type SchemaStorage interface {
+	// SetSchema 注册表结构, schema 为 nil 时删除表结构, 已写入的数据不会被转换
+	SetSchema(tablename string, schema *Schema) error
+	// Schema 返回注册的表结构
+	Schema(tablename string) (*Schema, bool)
+}
+
+// schemaRegistry 是 SchemaStorage 的实现, 它有自己的锁, 可以在 Set 加锁前检查数据
+type schemaRegistry struct {
+	schemaMu sync.RWMutex
+	schemas  map[string]*Schema
+}
+
+func (r *schemaRegistry) SetSchema(tablename string, schema *Schema) error {
+	if schema != nil {
+		if err := schema.Validate(); err != nil {
+			return errors.Wrap(err, "schema of table '"+tablename+"' is invalid")
+		}
+	}
+
+	r.schemaMu.Lock()
+	defer r.schemaMu.Unlock()
+	if schema == nil {
+		delete(r.schemas, tablename)
+		return nil
+	}
+	if r.schemas == nil {
+		r.schemas = map[string]*Schema{}
+	}
+	r.schemas[tablename] = schema
+	return nil
+}
+
+func (r *schemaRegistry) Schema(tablename string) (*Schema, bool) {
+	r.schemaMu.RLock()
+	defer r.schemaMu.RUnlock()
+	schema, ok := r.schemas[tablename]
+	return schema, ok
+}
+
+// check 按注册的表结构检查写入的数据, 读取出错时(err 不为 nil)只检查 tag 集
+func (r *schemaRegistry) check(tablename string, tags []KeyValue, data Table, err error) (Table, error) {
+	schema, ok := r.Schema(tablename)
+	if !ok {
+		return data, nil
+	}
+	if err != nil {
+		if _, e := schema.Check(tags, Table{}); e != nil {
+			return Table{}, errors.Wrap(e, "table '"+tablename+"' is invalid")
+		}
+		return data, nil
+	}
+	result, e := schema.Check(tags, data)
+	if e != nil {
+		return Table{}, errors.Wrap(e, "table '"+tablename+"' is invalid")
+	}
+	return result, nil
+}
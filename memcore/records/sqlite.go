@@ -0,0 +1,725 @@
+package records
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/runner-mei/errors"
+)
+
+// sqliteCatalog 是记录所有表名的表, 每个表分配一个 id
+const sqliteCatalog = "memsql_tables"
+
+// sqliteTagsCatalog 是记录所有表的 tag 和它对应列名的表
+const sqliteTagsCatalog = "memsql_tags"
+
+// sqliteStorage 是保存在 SQLite 中的 Storage.
+//
+// SQLite 的标识符是不区分大小写的, 所以表名和 tag 名不直接用作 SQLite 的标识符,
+// 而是在 sqliteCatalog 和 sqliteTagsCatalog 中记录原来的名字, 每个表对应一个名为 "m_" + id 的 SQLite 表, 列有
+//
+//   - _key       tag 集排序后的 KeyValues.ToKey(), 主键
+//   - _single    IsSingleValue
+//   - _time      数据读取的时间, unix 纳秒, 没有数据时为 0
+//   - _err_time  读取出错的时间
+//   - _err       读取出错的错误信息, 没有出错时为 NULL
+//   - _data      数据, 见 encodeTable
+//   - "t_" + n   每个 tag 一列, 没有这个 tag 时为 NULL
+//
+// 历史版本保存在名为 "v_" + id 的表中
+type sqliteStorage struct {
+	schemaRegistry
+
+	mu      sync.Mutex
+	conn    *sql.DB
+	history HistoryPolicy
+
+	// tables 是已经读取的表, 表名 -> 表
+	tables map[string]*sqliteTable
+}
+
+// sqliteTable 是一个表在 SQLite 中的标识符
+type sqliteTable struct {
+	id int64
+
+	// tags 是 tag 名 -> 列名
+	tags map[string]string
+}
+
+func (t *sqliteTable) data() string {
+	return quoteIdent("m_" + strconv.FormatInt(t.id, 10))
+}
+
+func (t *sqliteTable) versions() string {
+	return quoteIdent("v_" + strconv.FormatInt(t.id, 10))
+}
+
+// NewSQLiteStorage 创建一个保存在 conn 中的 Storage, 调用者需要导入 SQLite 的驱动
+func NewSQLiteStorage(conn *sql.DB, policy HistoryPolicy) (Storage, error) {
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS " + sqliteCatalog + " (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL UNIQUE)",
+		"CREATE TABLE IF NOT EXISTS " + sqliteTagsCatalog + " (table_id INTEGER, name TEXT, col TEXT, PRIMARY KEY(table_id, name))",
+	}
+	for _, stmt := range stmts {
+		if _, err := conn.Exec(stmt); err != nil {
+			return nil, errors.Wrap(err, "execute '"+stmt+"' fail")
+		}
+	}
+	return &sqliteStorage{
+		conn:    conn,
+		history: policy,
+		tables:  map[string]*sqliteTable{},
+	}, nil
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// loadTable 读取表的 id 和 tag 列, 表不存在时返回 false, 调用者必须持有 s.mu
+func (s *sqliteStorage) loadTable(tablename string) (*sqliteTable, bool, error) {
+	if table, ok := s.tables[tablename]; ok {
+		return table, true, nil
+	}
+
+	table := &sqliteTable{tags: map[string]string{}}
+	err := s.conn.QueryRow("SELECT id FROM "+sqliteCatalog+" WHERE name = ?", tablename).Scan(&table.id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, errors.Wrap(err, "read table '"+tablename+"' fail")
+	}
+
+	rows, err := s.conn.Query("SELECT name, col FROM "+sqliteTagsCatalog+" WHERE table_id = ?", table.id)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "read tags of table '"+tablename+"' fail")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, col string
+		if err := rows.Scan(&name, &col); err != nil {
+			return nil, false, errors.Wrap(err, "read tags of table '"+tablename+"' fail")
+		}
+		table.tags[name] = quoteIdent(col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, errors.Wrap(err, "read tags of table '"+tablename+"' fail")
+	}
+	s.tables[tablename] = table
+	return table, true, nil
+}
+
+// ensureTable 创建表和缺少的 tag 列, 调用者必须持有 s.mu
+func (s *sqliteStorage) ensureTable(tablename string, tags KeyValues) (*sqliteTable, error) {
+	table, ok, err := s.loadTable(tablename)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		table, err = s.createTable(tablename)
+		if err != nil {
+			return nil, errors.Wrap(err, "create table '"+tablename+"' fail")
+		}
+		s.tables[tablename] = table
+	}
+
+	for _, tag := range tags {
+		if _, ok := table.tags[tag.Key]; ok {
+			continue
+		}
+		if err := s.addTag(table, tag.Key); err != nil {
+			return nil, errors.Wrap(err, "add tag '"+tag.Key+"' to table '"+tablename+"' fail")
+		}
+	}
+	return table, nil
+}
+
+func (s *sqliteStorage) createTable(tablename string) (*sqliteTable, error) {
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO "+sqliteCatalog+" (name) VALUES (?)", tablename)
+	if err != nil {
+		return nil, err
+	}
+	table := &sqliteTable{tags: map[string]string{}}
+	table.id, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	stmts := []string{
+		"CREATE TABLE " + table.data() + " (_key TEXT PRIMARY KEY, _single INTEGER, _time INTEGER, _err_time INTEGER, _err TEXT, _data TEXT)",
+		"CREATE TABLE " + table.versions() + " (_key TEXT, _single INTEGER, _time INTEGER, _data TEXT, PRIMARY KEY(_key, _time))",
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// addTag 为 table 增加 tag 列和它的索引, 列名按 tag 加入的顺序编号, 所以只有大小写不同的 tag 也不会冲突
+func (s *sqliteStorage) addTag(table *sqliteTable, tag string) error {
+	n := strconv.Itoa(len(table.tags) + 1)
+	id := strconv.FormatInt(table.id, 10)
+	col := "t_" + n
+
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		"ALTER TABLE " + table.data() + " ADD COLUMN " + quoteIdent(col) + " TEXT",
+		"CREATE INDEX " + quoteIdent("i_"+id+"_"+n) + " ON " + table.data() + " (" + quoteIdent(col) + ")",
+	}
+	if _, err := tx.Exec("INSERT INTO "+sqliteTagsCatalog+" (table_id, name, col) VALUES (?, ?, ?)", table.id, tag, col); err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	table.tags[tag] = quoteIdent(col)
+	return nil
+}
+
+type sqliteData struct {
+	Columns []string     `json:"columns"`
+	Records [][]logValue `json:"records"`
+}
+
+func encodeData(table Table) (string, error) {
+	columns, records, err := encodeTable(table)
+	if err != nil {
+		return "", err
+	}
+	data := sqliteData{Columns: columns, Records: records}
+	bs, err := json.Marshal(data)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal data fail")
+	}
+	return string(bs), nil
+}
+
+func decodeData(tablename, s string) (Table, error) {
+	if s == "" {
+		return Table{}, nil
+	}
+	var data sqliteData
+	if err := json.Unmarshal([]byte(s), &data); err != nil {
+		return Table{}, errors.Wrap(err, "unmarshal data of table '"+tablename+"' fail")
+	}
+	table := decodeTable(data.Columns, data.Records)
+	for idx := range table.Columns {
+		table.Columns[idx].TableName = tablename
+	}
+	return table, nil
+}
+
+type sqliteRow struct {
+	key     string
+	tags    KeyValues
+	single  bool
+	time    int64
+	errTime int64
+	err     sql.NullString
+	data    string
+}
+
+func (row *sqliteRow) toMeasurement(tablename string) (Measurement, error) {
+	data, err := decodeData(tablename, row.data)
+	if err != nil {
+		return Measurement{}, err
+	}
+	m := Measurement{
+		Name:          TableName{Table: tablename, Tags: row.tags},
+		IsSingleValue: row.single,
+		Time:          fromUnixNano(row.time),
+		Data:          data,
+		ErrTime:       fromUnixNano(row.errTime),
+	}
+	if row.err.Valid {
+		m.Err = errors.New(row.err.String)
+	}
+	return m, nil
+}
+
+// query 读取 table 中满足 where 的行和 tags 中的 tag, 调用者必须持有 s.mu
+func (s *sqliteStorage) query(table *sqliteTable, tags map[string]string, where string, args ...interface{}) ([]sqliteRow, error) {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sqlstr := "SELECT _key, _single, _time, _err_time, _err, _data"
+	for _, key := range keys {
+		sqlstr += ", " + tags[key]
+	}
+	sqlstr += " FROM " + table.data()
+	if where != "" {
+		sqlstr += " WHERE " + where
+	}
+	sqlstr += " ORDER BY _key"
+
+	rows, err := s.conn.Query(sqlstr, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "execute '"+sqlstr+"' fail")
+	}
+	defer rows.Close()
+
+	var results []sqliteRow
+	for rows.Next() {
+		var row sqliteRow
+		tagValues := make([]sql.NullString, len(keys))
+		dest := []interface{}{&row.key, &row.single, &row.time, &row.errTime, &row.err, &row.data}
+		for idx := range tagValues {
+			dest = append(dest, &tagValues[idx])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrap(err, "execute '"+sqlstr+"' fail")
+		}
+		for idx, value := range tagValues {
+			if value.Valid {
+				row.tags = append(row.tags, KeyValue{Key: keys[idx], Value: value.String})
+			}
+		}
+		results = append(results, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "execute '"+sqlstr+"' fail")
+	}
+	return results, nil
+}
+
+func (s *sqliteStorage) From(tablename string, filter func(name TableName) (bool, error)) ([]Measurement, error) {
+	return s.FromTags(tablename, nil, filter)
+}
+
+func (s *sqliteStorage) FromTags(tablename string, tagsList [][]KeyValue, filter func(name TableName) (bool, error)) ([]Measurement, error) {
+	rows, err := s.rowsOf(tablename, tagsList)
+	if err != nil {
+		return nil, err
+	}
+	return filterRows(tablename, rows, filter)
+}
+
+// rowsOf 读取 tagsList 中的 tag 集对应的行, tagsList 为 nil 时读取所有的行
+func (s *sqliteStorage) rowsOf(tablename string, tagsList [][]KeyValue) ([]sqliteRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	table, ok, err := s.loadTable(tablename)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, TableNotExists(tablename)
+	}
+
+	where, args, ok := tagsWhere(table.tags, tagsList)
+	if !ok {
+		return nil, TableNotExists(tablename)
+	}
+	return s.query(table, table.tags, where, args...)
+}
+
+// filterRows 用 filter 过滤 rows 并转换为 Measurement, 它不需要持有 s.mu, 所以 filter 中可以访问 Storage
+func filterRows(tablename string, rows []sqliteRow, filter func(name TableName) (bool, error)) ([]Measurement, error) {
+	var list []Measurement
+	for idx := range rows {
+		ok, err := filter(TableName{Table: tablename, Tags: rows[idx].tags})
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, TableNotExists(tablename, err)
+		}
+		if !ok {
+			continue
+		}
+		m, err := rows[idx].toMeasurement(tablename)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	if len(list) == 0 {
+		return nil, TableNotExists(tablename)
+	}
+	return list, nil
+}
+
+// tagsWhere 将 tagsList 转换为查询条件, 不可能有满足条件的行时返回 false
+func tagsWhere(columns map[string]string, tagsList [][]KeyValue) (string, []interface{}, bool) {
+	if tagsList == nil {
+		return "", nil, true
+	}
+
+	var conds []string
+	var args []interface{}
+	for _, tags := range tagsList {
+		if len(tags) == 0 {
+			// 有一组没有约束时需要查找所有的 measurement
+			return "", nil, true
+		}
+
+		var ands []string
+		var values []interface{}
+		for _, tag := range tags {
+			column, ok := columns[tag.Key]
+			if !ok {
+				ands = nil
+				break
+			}
+			ands = append(ands, column+" = ?")
+			values = append(values, tag.Value)
+		}
+		if ands == nil {
+			continue
+		}
+		conds = append(conds, "("+strings.Join(ands, " AND ")+")")
+		args = append(args, values...)
+	}
+	if len(conds) == 0 {
+		return "", nil, false
+	}
+	return strings.Join(conds, " OR "), args, true
+}
+
+func (s *sqliteStorage) Versions(tablename string, tagsList [][]KeyValue, filter func(name TableName) (bool, error), begin, end time.Time) ([]Measurement, error) {
+	list, err := s.FromTags(tablename, tagsList, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	table, ok, err := s.loadTable(tablename)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, TableNotExists(tablename)
+	}
+
+	inRange := func(t time.Time) bool {
+		if t.IsZero() || t.Before(begin) {
+			return false
+		}
+		return end.IsZero() || !t.After(end)
+	}
+
+	var results []Measurement
+	for _, m := range list {
+		key := m.Name.Tags.ToKey()
+		rows, err := s.conn.Query("SELECT _single, _time, _data FROM "+table.versions()+" WHERE _key = ? ORDER BY _time", key)
+		if err != nil {
+			return nil, errors.Wrap(err, "read versions of table '"+tablename+"' fail")
+		}
+		for rows.Next() {
+			var row sqliteRow
+			if err := rows.Scan(&row.single, &row.time, &row.data); err != nil {
+				rows.Close()
+				return nil, errors.Wrap(err, "read versions of table '"+tablename+"' fail")
+			}
+			row.tags = m.Name.Tags
+			if !inRange(fromUnixNano(row.time)) {
+				continue
+			}
+			version, err := row.toMeasurement(tablename)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			results = append(results, version)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "read versions of table '"+tablename+"' fail")
+		}
+
+		if inRange(m.Time) {
+			m.ErrTime = time.Time{}
+			m.Err = nil
+			results = append(results, m)
+		}
+	}
+	if len(results) == 0 {
+		return nil, TableNotExists(tablename)
+	}
+	return results, nil
+}
+
+func (s *sqliteStorage) Set(name string, tags []KeyValue, isSingleValue bool, t time.Time, data Table, err error) error {
+	data, e := s.check(name, tags, data, err)
+	if e != nil {
+		return e
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copyed := KeyValues(CloneKeyValues(tags))
+	sort.Sort(copyed)
+	key := copyed.ToKey()
+
+	table, e := s.ensureTable(name, copyed)
+	if e != nil {
+		return e
+	}
+	rows, e := s.query(table, nil, "_key = ?", key)
+	if e != nil {
+		return e
+	}
+
+	row := sqliteRow{
+		key:     key,
+		tags:    copyed,
+		single:  isSingleValue,
+		time:    unixNano(t),
+		errTime: unixNano(t),
+	}
+	if err != nil {
+		// 读取出错时保留上一次成功读取的数据
+		row.err = sql.NullString{String: err.Error(), Valid: true}
+		row.single = false
+		row.time = 0
+		if len(rows) > 0 {
+			row.single = rows[0].single
+			row.time = rows[0].time
+			row.data = rows[0].data
+		}
+	} else {
+		row.data, e = encodeData(data)
+		if e != nil {
+			return e
+		}
+	}
+
+	tx, e := s.conn.Begin()
+	if e != nil {
+		return errors.Wrap(e, "begin transaction fail")
+	}
+	defer tx.Rollback()
+
+	if err == nil && len(rows) > 0 && row.time < rows[0].time {
+		// 比当前数据旧的数据(如乱序到达)不替换当前数据, 只加入历史版本
+		if !s.history.enabled() {
+			return nil
+		}
+		if e := s.addVersion(tx, name, table, row, fromUnixNano(rows[0].time)); e != nil {
+			return e
+		}
+		if e := tx.Commit(); e != nil {
+			return errors.Wrap(e, "commit transaction fail")
+		}
+		return nil
+	}
+	if err == nil && len(rows) > 0 && rows[0].time != 0 && rows[0].time != row.time && s.history.enabled() {
+		if e := s.addVersion(tx, name, table, rows[0], t); e != nil {
+			return e
+		}
+	}
+
+	names := []string{"_key", "_single", "_time", "_err_time", "_err", "_data"}
+	args := []interface{}{row.key, row.single, row.time, row.errTime, row.err, row.data}
+	for _, tag := range copyed {
+		names = append(names, table.tags[tag.Key])
+		args = append(args, tag.Value)
+	}
+	sqlstr := "INSERT OR REPLACE INTO " + table.data() + " (" + strings.Join(names, ", ") + ") VALUES (?" + strings.Repeat(", ?", len(names)-1) + ")"
+	if _, e := tx.Exec(sqlstr, args...); e != nil {
+		return errors.Wrap(e, "execute '"+sqlstr+"' fail")
+	}
+	if e := tx.Commit(); e != nil {
+		return errors.Wrap(e, "commit transaction fail")
+	}
+	return nil
+}
+
+// addVersion 将 old 加入历史版本, 并删除超出 HistoryPolicy 的版本, t 是最新版本的时间
+func (s *sqliteStorage) addVersion(tx *sql.Tx, tablename string, table *sqliteTable, old sqliteRow, t time.Time) error {
+	versions := table.versions()
+	_, err := tx.Exec("INSERT OR REPLACE INTO "+versions+" (_key, _single, _time, _data) VALUES (?, ?, ?, ?)",
+		old.key, old.single, old.time, old.data)
+	if err != nil {
+		return errors.Wrap(err, "add version to table '"+tablename+"' fail")
+	}
+
+	if s.history.MaxAge > 0 {
+		_, err = tx.Exec("DELETE FROM "+versions+" WHERE _key = ? AND _time < ?", old.key, t.Add(-s.history.MaxAge).UnixNano())
+		if err != nil {
+			return errors.Wrap(err, "remove versions of table '"+tablename+"' fail")
+		}
+	}
+	if s.history.MaxVersions > 0 {
+		_, err = tx.Exec("DELETE FROM "+versions+" WHERE _key = ? AND _time NOT IN (SELECT _time FROM "+versions+" WHERE _key = ? ORDER BY _time DESC LIMIT ?)",
+			old.key, old.key, s.history.MaxVersions)
+		if err != nil {
+			return errors.Wrap(err, "remove versions of table '"+tablename+"' fail")
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStorage) Exists(tablename string, tags []KeyValue, predateLimit, errPredateLimit time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	table, ok, err := s.loadTable(tablename)
+	if err != nil || !ok {
+		return false
+	}
+
+	copyed := KeyValues(CloneKeyValues(tags))
+	sort.Sort(copyed)
+
+	rows, err := s.query(table, nil, "_key = ?", copyed.ToKey())
+	if err != nil || len(rows) == 0 {
+		return false
+	}
+	if predateLimit.Before(fromUnixNano(rows[0].time)) {
+		return true
+	}
+	return rows[0].err.Valid && errPredateLimit.Before(fromUnixNano(rows[0].errTime))
+}
+
+func (s *sqliteStorage) Tables() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.conn.Query("SELECT id, name FROM " + sqliteCatalog + " ORDER BY name")
+	if err != nil {
+		return nil
+	}
+	var names []string
+	var tables []sqliteTable
+	for rows.Next() {
+		var name string
+		var table sqliteTable
+		if err := rows.Scan(&table.id, &name); err != nil {
+			break
+		}
+		names = append(names, name)
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	// 只返回有数据的表
+	var results []string
+	for idx, name := range names {
+		var one int
+		err := s.conn.QueryRow("SELECT 1 FROM " + tables[idx].data() + " LIMIT 1").Scan(&one)
+		if err == nil {
+			results = append(results, name)
+		}
+	}
+	return results
+}
+
+func (s *sqliteStorage) TagSets(tablename string) ([]KeyValues, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	table, ok, err := s.loadTable(tablename)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, TableNotExists(tablename)
+	}
+	rows, err := s.query(table, table.tags, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, TableNotExists(tablename)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].key < rows[j].key
+	})
+	tagsList := make([]KeyValues, len(rows))
+	for idx := range rows {
+		tagsList[idx] = rows[idx].tags
+	}
+	return tagsList, nil
+}
+
+func (s *sqliteStorage) Delete(tablename string, tags []KeyValue) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	table, ok, err := s.loadTable(tablename)
+	if err != nil || !ok {
+		return false
+	}
+
+	copyed := KeyValues(CloneKeyValues(tags))
+	sort.Sort(copyed)
+	key := copyed.ToKey()
+
+	result, err := s.conn.Exec("DELETE FROM "+table.data()+" WHERE _key = ?", key)
+	if err != nil {
+		return false
+	}
+	s.conn.Exec("DELETE FROM "+table.versions()+" WHERE _key = ?", key)
+	count, err := result.RowsAffected()
+	return err == nil && count > 0
+}
+
+func (s *sqliteStorage) Clear(tablename string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	table, ok, err := s.loadTable(tablename)
+	if err != nil || !ok {
+		return 0
+	}
+
+	result, err := s.conn.Exec("DELETE FROM " + table.data())
+	if err != nil {
+		return 0
+	}
+	s.conn.Exec("DELETE FROM " + table.versions())
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return int(count)
+}
@@ -1,9 +1,11 @@
 package records
 
 import (
+	"net/http"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/runner-mei/errors"
@@ -12,25 +14,36 @@ import (
 
 var ErrNotFound = vm.ErrNotFound
 
+// withTitle 同 errors.WithTitle, 但返回新的错误, 不修改 err, 因为 err 通常是多个查询共享的全局变量
+func withTitle(err error, title string) error {
+	e := errors.ToError(err, http.StatusInternalServerError)
+	return &errors.Error{
+		Code:    e.Code,
+		Message: title,
+		Details: e.Message,
+		Cause:   err,
+	}
+}
+
 func TableNotExists(table string, err ...error) error {
 	if len(err) > 0 && err[0] != nil {
-		return errors.WithTitle(errors.ErrTableNotExists, "table '"+table+"' isnot exists: "+err[0].Error())
+		return withTitle(errors.ErrTableNotExists, "table '"+table+"' isnot exists: "+err[0].Error())
 	}
-	return errors.WithTitle(errors.ErrTableNotExists, "table '"+table+"' isnot exists")
+	return withTitle(errors.ErrTableNotExists, "table '"+table+"' isnot exists")
 }
 
 func ColumnNotFound(tableName, columnName string) error {
 	if tableName != "" {
-		return errors.WithTitle(ErrNotFound, "column '"+tableName+"."+columnName+"' isnot found")
+		return withTitle(ErrNotFound, "column '"+tableName+"."+columnName+"' isnot found")
 	}
-	return errors.WithTitle(ErrNotFound, "column '"+columnName+"' isnot found")
+	return withTitle(ErrNotFound, "column '"+columnName+"' isnot found")
 }
 
 func TagNotFound(tableName, tagName string) error {
 	if tableName == "" {
-		return errors.WithTitle(ErrNotFound, "tag '"+tagName+"' isnot found")
+		return withTitle(ErrNotFound, "tag '"+tagName+"' isnot found")
 	}
-	return errors.WithTitle(ErrNotFound, "tag '"+tableName+"."+tagName+"' isnot found")
+	return withTitle(ErrNotFound, "tag '"+tableName+"."+tagName+"' isnot found")
 }
 
 // type Context interface{}
@@ -144,52 +157,303 @@ type Measurement struct {
 // }
 
 type Storage interface {
+	// From 返回 tag 满足 filter 的 measurement, 读取出错的 measurement 也会返回, 它的 Err
+	// 不为 nil, 由调用者决定如何处理
 	From(tablename string, filter func(name TableName) (bool, error)) ([]Measurement, error)
+	// FromTags 同 From, 但只查找 tag 包含 tagsList 中某一组 key/value 的 measurement,
+	// tagsList 为 nil 时同 From
+	FromTags(tablename string, tagsList [][]KeyValue, filter func(name TableName) (bool, error)) ([]Measurement, error)
+	// Versions 同 FromTags, 但返回 measurement 保留的所有版本(包括当前版本)中时间在
+	// [begin, end] 之间的版本, 同一个 tag 集的版本按时间从旧到新排列, end 为零值时没有上限
+	Versions(tablename string, tagsList [][]KeyValue, filter func(name TableName) (bool, error), begin, end time.Time) ([]Measurement, error)
 	Set(name string, tags []KeyValue, isSingleValue bool, t time.Time, table Table, err error) error
-	Exists(name string, tags []KeyValue, predateLimit time.Time) bool
+	// Exists 判断数据是否仍然有效, 数据在 predateLimit 之后读取的或读取出错的时间在
+	// errPredateLimit 之后时返回 true
+	Exists(name string, tags []KeyValue, predateLimit, errPredateLimit time.Time) bool
+
+	// Tables 返回所有的表名, 按名称排列
+	Tables() []string
+	// TagSets 返回表中所有 measurement 的 tag 集, 按 KeyValues.ToKey() 排列
+	TagSets(tablename string) ([]KeyValues, error)
+	// Delete 删除 tag 集为 tags 的 measurement 以及它的历史版本, 不存在时返回 false
+	Delete(tablename string, tags []KeyValue) bool
+	// Clear 删除表中所有的 measurement, 返回删除的个数
+	Clear(tablename string) int
 }
 
+// storage 是内存中的 Storage
+//
+// 写操作(Set, Delete, Clear 以及淘汰和过期)由 mu 串行执行, 所以索引, 历史版本, usage 和计数器总是一致的.
+// 每个表有自己的读写锁, 读操作只在表的读锁中复制需要的 measurement, 之后在锁外调用 filter,
+// 因此读操作不会互相阻塞, 也只会被正在修改同一个表的写操作短暂地阻塞
 type storage struct {
-	mu           sync.Mutex
-	measurements map[string]map[string]Measurement
+	schemaRegistry
+
+	// mu 串行化写操作, 并保护 usages, count, bytes, tick, evictions 和 expirations
+	mu sync.Mutex
+	// tables 是 map[string]*memTable, 它是写时复制的, 只有持有 mu 时才能替换
+	tables atomic.Value
+
+	history  HistoryPolicy
+	capacity CapacityPolicy
+	now      func() time.Time
+	// usages 是 measurement 占用的内存和访问顺序, 表名 -> usage
+	usages map[string]*tableUsage
+	count  int
+	bytes  int64
+	tick   uint64
+
+	evictions, expirations uint64
+	// hits 和 misses 由读操作更新, 必须用原子操作访问
+	hits, misses uint64
+
+	// touchMu 保护 touches, 读操作只记录访问过的 measurement, 由写操作按顺序更新 LRU
+	touchMu sync.Mutex
+	touches []touched
+}
+
+// memTable 是一个表的数据, 读操作必须持有 mu 的读锁, 写操作必须同时持有 storage.mu 和 mu 的写锁,
+// 只持有 storage.mu 时可以读取但不能修改
+type memTable struct {
+	mu           sync.RWMutex
+	measurements map[string]Measurement
+
+	// index 是 tag 的倒排索引, "key=value" -> measurement 的 key
+	index map[string]map[string]struct{}
+
+	// versions 是 measurement 的历史版本, measurement 的 key -> 按时间从旧到新排列的版本,
+	// 每次修改都会生成新的切片, 所以读操作复制切片后可以在锁外使用
+	versions map[string][]Measurement
+
+	// updated 是 measurement 最后写入的时间, 用于读操作判断 TTL
+	updated map[string]time.Time
+}
+
+func newMemTable() *memTable {
+	return &memTable{
+		measurements: map[string]Measurement{},
+		index:        map[string]map[string]struct{}{},
+		versions:     map[string][]Measurement{},
+		updated:      map[string]time.Time{},
+	}
 }
 
 func NewStorage() Storage {
-	return &storage{
-		measurements: map[string]map[string]Measurement{},
+	return NewStorageWithOptions(StorageOptions{})
+}
+
+// NewStorageWithHistory 创建一个按 policy 保留 measurement 历史版本的 Storage
+func NewStorageWithHistory(policy HistoryPolicy) Storage {
+	return NewStorageWithOptions(StorageOptions{History: policy})
+}
+
+// NewStorageWithOptions 创建一个按 opts 保留历史版本和限制内存占用的 Storage
+func NewStorageWithOptions(opts StorageOptions) Storage {
+	now := opts.Now
+	if now == nil {
+		now = time.Now
 	}
+	s := &storage{
+		history:  opts.History,
+		capacity: opts.Capacity,
+		now:      now,
+		usages:   map[string]*tableUsage{},
+	}
+	s.tables.Store(map[string]*memTable{})
+	return s
+}
+
+func (s *storage) loadTables() map[string]*memTable {
+	return s.tables.Load().(map[string]*memTable)
+}
+
+// table 返回表, 不存在时返回 nil
+func (s *storage) table(tablename string) *memTable {
+	return s.loadTables()[tablename]
+}
+
+// tableForWrite 返回表, 不存在时创建它, 调用者必须持有 s.mu
+func (s *storage) tableForWrite(tablename string) *memTable {
+	tables := s.loadTables()
+	if t := tables[tablename]; t != nil {
+		return t
+	}
+	t := newMemTable()
+	copyed := make(map[string]*memTable, len(tables)+1)
+	for name, old := range tables {
+		copyed[name] = old
+	}
+	copyed[tablename] = t
+	s.tables.Store(copyed)
+	return t
+}
+
+// dropTable 删除空的表, 调用者必须持有 s.mu
+func (s *storage) dropTable(tablename string) {
+	tables := s.loadTables()
+	if _, ok := tables[tablename]; !ok {
+		return
+	}
+	copyed := make(map[string]*memTable, len(tables))
+	for name, old := range tables {
+		if name != tablename {
+			copyed[name] = old
+		}
+	}
+	s.tables.Store(copyed)
+}
+
+func (s *storage) isExpired(updated, now time.Time) bool {
+	return s.capacity.TTL > 0 && now.Sub(updated) > s.capacity.TTL
 }
 
 func (s *storage) From(tablename string, filter func(name TableName) (bool, error)) ([]Measurement, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.FromTags(tablename, nil, filter)
+}
 
-	byKey := s.measurements[tablename]
-	if len(byKey) == 0 {
-		return nil, TableNotExists(tablename)
+func (s *storage) FromTags(tablename string, tagsList [][]KeyValue, filter func(name TableName) (bool, error)) ([]Measurement, error) {
+	list, _, err := s.fromTags(tablename, tagsList, filter, false)
+	return list, err
+}
+
+// snapshot 在表的读锁中复制 tag 包含 tagsList 中某一组 key/value 并且没有过期的 measurement,
+// withVersions 为 true 时同时复制它们的历史版本
+func (s *storage) snapshot(tablename string, tagsList [][]KeyValue, withVersions bool) ([]Measurement, [][]Measurement) {
+	t := s.table(tablename)
+	if t == nil {
+		return nil, nil
+	}
+	now := s.now()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var keys []string
+	if found, ok := t.lookup(tagsList); ok {
+		keys = found
+	} else {
+		keys = make([]string, 0, len(t.measurements))
+		for key := range t.measurements {
+			keys = append(keys, key)
+		}
+	}
+
+	candidates := make([]Measurement, 0, len(keys))
+	var versions [][]Measurement
+	for _, key := range keys {
+		m, ok := t.measurements[key]
+		if !ok || s.isExpired(t.updated[key], now) {
+			// 过期的 measurement 由下一次写操作删除
+			continue
+		}
+		candidates = append(candidates, m)
+		if withVersions {
+			versions = append(versions, t.versions[key])
+		}
+	}
+	return candidates, versions
+}
+
+// fromTags 同 FromTags, filter 在锁外调用, withVersions 为 true 时同时返回每个 measurement 的历史版本
+func (s *storage) fromTags(tablename string, tagsList [][]KeyValue, filter func(name TableName) (bool, error), withVersions bool) ([]Measurement, [][]Measurement, error) {
+	candidates, versions := s.snapshot(tablename, tagsList, withVersions)
+	if len(candidates) == 0 {
+		return nil, nil, TableNotExists(tablename)
 	}
 
 	var list []Measurement
-	for _, m := range byKey {
+	var listVersions [][]Measurement
+	var keys []string
+	for idx, m := range candidates {
 		ok, err := filter(m.Name)
 		if err != nil {
 			if errors.Is(err, ErrNotFound) {
 				continue
 			}
 
-			return nil, TableNotExists(tablename, err)
-		}
-		if m.Err != nil {
-			return nil, m.Err
+			return nil, nil, TableNotExists(tablename, err)
 		}
 		if ok {
+			keys = append(keys, m.Name.Tags.ToKey())
 			list = append(list, m)
+			if withVersions {
+				listVersions = append(listVersions, versions[idx])
+			}
 		}
 	}
 	if len(list) == 0 {
-		return nil, TableNotExists(tablename)
+		return nil, nil, TableNotExists(tablename)
 	}
-	return list, nil
+	s.touch(tablename, keys...)
+
+	// 按 tag 集排序, 这样查询结果的顺序是稳定的
+	sort.Sort(byTags{list: list, versions: listVersions, keys: keys})
+	return list, listVersions, nil
+}
+
+// byTags 将 measurement 和它的历史版本一起按 tag 集排序
+type byTags struct {
+	list     []Measurement
+	versions [][]Measurement
+	keys     []string
+}
+
+func (b byTags) Len() int {
+	return len(b.list)
+}
+
+func (b byTags) Less(i, j int) bool {
+	return b.keys[i] < b.keys[j]
+}
+
+func (b byTags) Swap(i, j int) {
+	b.list[i], b.list[j] = b.list[j], b.list[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	if b.versions != nil {
+		b.versions[i], b.versions[j] = b.versions[j], b.versions[i]
+	}
+}
+
+// lookup 用倒排索引查找 tag 包含 tagsList 中某一组 key/value 的 measurement,
+// 不能使用索引时返回 false, 调用者必须持有 t.mu 的读锁
+func (t *memTable) lookup(tagsList [][]KeyValue) ([]string, bool) {
+	if tagsList == nil {
+		return nil, false
+	}
+	for _, tags := range tagsList {
+		if len(tags) == 0 {
+			// 有一组没有约束时需要查找所有的 measurement
+			return nil, false
+		}
+	}
+
+	seen := map[string]struct{}{}
+	var keys []string
+	for _, tags := range tagsList {
+		// 从最短的倒排表开始求交集
+		var smallest map[string]struct{}
+		for idx, tag := range tags {
+			posting := t.index[tag.Key+"="+tag.Value]
+			if idx == 0 || len(posting) < len(smallest) {
+				smallest = posting
+			}
+		}
+
+	next:
+		for key := range smallest {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			for _, tag := range tags {
+				if _, ok := t.index[tag.Key+"="+tag.Value][key]; !ok {
+					continue next
+				}
+			}
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	return keys, true
 }
 
 // func (s *storage) From(ctx Context, tablename string, filter func(ctx GetValuer) (bool, error), trace func(TableName)) (Query, error) {
@@ -250,64 +514,183 @@ func (s *storage) From(tablename string, filter func(name TableName) (bool, erro
 // }
 
 func (s *storage) Set(name string, tags []KeyValue, isSingleValue bool, t time.Time, data Table, err error) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	byKey := s.measurements[name]
-	if byKey == nil {
-		byKey = map[string]Measurement{}
-		s.measurements[name] = byKey
+	data, e := s.check(name, tags, data, err)
+	if e != nil {
+		return e
 	}
 
 	for idx := range data.Columns {
 		data.Columns[idx].TableName = name
 	}
+	data.cacheColumnar()
 
 	copyed := KeyValues(CloneKeyValues(tags))
 	sort.Sort(copyed)
 	key := KeyValues(copyed).ToKey()
 
 	m := Measurement{
-		Name:    TableName{Table: name, Tags: copyed},
+		Name:          TableName{Table: name, Tags: copyed},
 		IsSingleValue: isSingleValue,
-		Time:    t,
-		Data:    data,
-		ErrTime: t,
-		Err:     err,
+		Time:          t,
+		Data:          data,
+		ErrTime:       t,
+		Err:           err,
 	}
 
-	old, ok := byKey[key]
-	if ok {
-		if err != nil {
-			m.Data = old.Data
-			m.Time = old.Time
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.applyTouches()
+	s.expire(now)
+
+	table := s.tableForWrite(name)
+	table.mu.Lock()
+	old, exists := table.measurements[key]
+	if err == nil && exists && t.Before(old.Time) {
+		// 比当前数据旧的数据(如乱序到达)不替换当前数据, 只加入历史版本
+		s.addVersion(table, key, m, old.Time)
+		table.mu.Unlock()
+
+		s.resize(name, key)
+		s.evict(name, key)
+		return nil
+	}
+	if err != nil {
+		// 读取出错时保留上一次成功读取的数据, 没有时 Time 为零值
+		m.IsSingleValue = old.IsSingleValue
+		m.Data = old.Data
+		m.Time = old.Time
+	} else if exists && !old.Time.Equal(t) {
+		// 同一时间的数据重复写入时(如从日志中恢复)不产生新的版本
+		s.addVersion(table, key, old, t)
+	}
+	table.measurements[key] = m
+	table.updated[key] = now
+
+	if !exists {
+		for _, tag := range copyed {
+			posting := table.index[tag.Key+"="+tag.Value]
+			if posting == nil {
+				posting = map[string]struct{}{}
+				table.index[tag.Key+"="+tag.Value] = posting
+			}
+			posting[key] = struct{}{}
 		}
 	}
-	byKey[key] = m
+	table.mu.Unlock()
+
+	s.account(name, key, now)
+	s.evict(name, key)
 	return nil
 }
 
-func (s *storage) Exists(tablename string, tags []KeyValue, predateLimit time.Time) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	byKey := s.measurements[tablename]
-	if len(byKey) == 0 {
+func (s *storage) Exists(tablename string, tags []KeyValue, predateLimit, errPredateLimit time.Time) bool {
+	table := s.table(tablename)
+	if table == nil {
+		atomic.AddUint64(&s.misses, 1)
 		return false
 	}
 
-	key := KeyValues(tags).ToKey()
-	old, ok := byKey[key]
-	if !ok {
+	copyed := KeyValues(CloneKeyValues(tags))
+	sort.Sort(copyed)
+	key := copyed.ToKey()
+
+	table.mu.RLock()
+	old, ok := table.measurements[key]
+	updated := table.updated[key]
+	table.mu.RUnlock()
+
+	if !ok || s.isExpired(updated, s.now()) {
+		atomic.AddUint64(&s.misses, 1)
 		return false
 	}
-	if predateLimit.Before(old.Time) {
+	if predateLimit.Before(old.Time) ||
+		(old.Err != nil && errPredateLimit.Before(old.ErrTime)) {
+		atomic.AddUint64(&s.hits, 1)
+		s.touch(tablename, key)
 		return true
 	}
-	if old.Err != nil {
-		if predateLimit.Before(old.ErrTime) {
-			return true
+	atomic.AddUint64(&s.misses, 1)
+	return false
+}
+
+func (s *storage) Tables() []string {
+	tables := s.loadTables()
+	names := make([]string, 0, len(tables))
+	for name, table := range tables {
+		table.mu.RLock()
+		count := len(table.measurements)
+		table.mu.RUnlock()
+		if count > 0 {
+			names = append(names, name)
 		}
 	}
-	return false
+	sort.Strings(names)
+	return names
+}
+
+func (s *storage) TagSets(tablename string) ([]KeyValues, error) {
+	table := s.table(tablename)
+	if table == nil {
+		return nil, TableNotExists(tablename)
+	}
+
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+
+	if len(table.measurements) == 0 {
+		return nil, TableNotExists(tablename)
+	}
+
+	keys := make([]string, 0, len(table.measurements))
+	for key := range table.measurements {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tagsList := make([]KeyValues, 0, len(keys))
+	for _, key := range keys {
+		tagsList = append(tagsList, CloneKeyValues(table.measurements[key].Name.Tags))
+	}
+	return tagsList, nil
+}
+
+func (s *storage) Delete(tablename string, tags []KeyValue) bool {
+	copyed := KeyValues(CloneKeyValues(tags))
+	sort.Sort(copyed)
+	key := copyed.ToKey()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.applyTouches()
+	table := s.table(tablename)
+	if table == nil {
+		return false
+	}
+	if _, ok := table.measurements[key]; !ok {
+		return false
+	}
+	s.remove(tablename, key)
+	return true
+}
+
+func (s *storage) Clear(tablename string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.applyTouches()
+	table := s.table(tablename)
+	if table == nil {
+		return 0
+	}
+	keys := make([]string, 0, len(table.measurements))
+	for key := range table.measurements {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		s.remove(tablename, key)
+	}
+	return len(keys)
 }
@@ -2,6 +2,7 @@ package records
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 
 	"github.com/runner-mei/errors"
@@ -11,6 +12,8 @@ import (
 type Table struct {
 	Columns []Column
 	Records [][]Value
+
+	columnar *columnarCache
 }
 
 func (table *Table) ForEach(fn func(columns []Column, record []Value)) {
@@ -20,6 +23,8 @@ func (table *Table) ForEach(fn func(columns []Column, record []Value)) {
 }
 
 func (table *Table) Add(columns []Column, values []Value) {
+	table.columnar = nil
+
 	if table.Columns == nil {
 		table.Columns = make([]Column, len(columns))
 		copy(table.Columns, columns)
@@ -35,8 +40,11 @@ func (table *Table) Add(columns []Column, values []Value) {
 	for idx, value := range values {
 		foundIndex := columnSearchByName(table.Columns, columns[idx].Name)
 		if foundIndex < 0 {
-			// 这里添加了一列，那么前几行的列值的数目会少于 Columns
+			// 这里添加了一列, 前几行要补上 null
 			table.Columns = append(table.Columns, Column{Name: columns[idx].Name})
+			for i := range table.Records {
+				table.Records[i] = append(table.Records[i], vm.Null())
+			}
 			record = append(record, value)
 		} else {
 			record[foundIndex] = value
@@ -88,37 +96,43 @@ func ToMap(columns []Column, record []Value) map[string]interface{} {
 	return values
 }
 
+// ToTable 将 values 转换为 Table, 列按名称排序, 每一行都有所有的列, 缺少的值为 null,
+// 需要指定列的顺序和类型时用 ToTableWithSchema
 func ToTable(values []map[string]interface{}) (Table, error) {
 	if len(values) == 0 {
 		return Table{}, nil
 	}
-	var table = Table{}
-	var record []Value
-	for key, value := range values[0] {
-		table.Columns = append(table.Columns, Column{Name: key})
-		v, err := vm.ToValue(value)
-		if err != nil {
-			return table, errors.Wrap(err, "value '"+fmt.Sprint(value)+"' with index is '0' and column is '"+key+"' is invalid ")
+
+	var names []string
+	seen := map[string]struct{}{}
+	for _, value := range values {
+		for key := range value {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			names = append(names, key)
 		}
-		record = append(record, v)
 	}
-	table.Records = append(table.Records, record)
+	sort.Strings(names)
 
-	for i := 1; i < len(values); i++ {
-		record = make([]Value, len(table.Columns))
-		for key, value := range values[i] {
+	var table = Table{}
+	for _, name := range names {
+		table.Columns = append(table.Columns, Column{Name: name})
+	}
+	for i := range values {
+		record := make([]Value, len(names))
+		for idx, key := range names {
+			value, ok := values[i][key]
+			if !ok {
+				record[idx] = vm.Null()
+				continue
+			}
 			v, err := vm.ToValue(value)
 			if err != nil {
 				return table, errors.Wrap(err, "value '"+fmt.Sprint(value)+"' with index is '"+strconv.Itoa(i)+"' and column is '"+key+"' is invalid ")
 			}
-			foundIndex := columnSearchByName(table.Columns, key)
-			if foundIndex < 0 {
-				// 这里添加了一列，那么前几行的列值的数目会少于 Columns
-				table.Columns = append(table.Columns, Column{Name: key})
-				record = append(record, v)
-			} else {
-				record[foundIndex] = v
-			}
+			record[idx] = v
 		}
 		table.Records = append(table.Records, record)
 	}
@@ -0,0 +1,156 @@
+package records
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/runner-mei/errors"
+)
+
+// ChangeOp 是 Storage 中数据变化的类型
+type ChangeOp int
+
+const (
+	ChangeSet ChangeOp = iota
+	ChangeDelete
+	ChangeClear
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeSet:
+		return "set"
+	case ChangeDelete:
+		return "delete"
+	case ChangeClear:
+		return "clear"
+	default:
+		return "unknown"
+	}
+}
+
+// Change 是 Storage 中一个表的变化, Op 为 ChangeClear 时 Tags 为 nil
+type Change struct {
+	Op    ChangeOp
+	Table string
+	Tags  KeyValues
+	// Time 是 Set 时数据的时间, Delete 和 Clear 时为零值
+	Time time.Time
+}
+
+// ChangeNotifier 是数据变化时发出通知的 Storage
+type ChangeNotifier interface {
+	// Watch 注册一个回调, 每次 Set, Delete 或 Clear 改变了数据后调用它, 返回的函数用于取消注册
+	Watch(fn func(Change)) (cancel func())
+}
+
+// WatchedStorage 包装一个 Storage, 在 Set, Delete 和 Clear 成功后通知注册的回调
+//
+// 回调在写操作的 goroutine 中按注册的顺序调用, 它不能阻塞. 因为超过容量或 TTL 而被删除的
+// measurement 不会通知
+type WatchedStorage struct {
+	Storage
+
+	mu       sync.RWMutex
+	nextID   int
+	watchers map[int]func(Change)
+	order    []int
+}
+
+// NewWatchedStorage 返回在数据变化时发出通知的 s
+func NewWatchedStorage(s Storage) *WatchedStorage {
+	return &WatchedStorage{
+		Storage:  s,
+		watchers: map[int]func(Change){},
+	}
+}
+
+func (ws *WatchedStorage) Watch(fn func(Change)) func() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	id := ws.nextID
+	ws.nextID++
+	ws.watchers[id] = fn
+	ws.order = append(ws.order, id)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ws.mu.Lock()
+			defer ws.mu.Unlock()
+
+			delete(ws.watchers, id)
+			for idx := range ws.order {
+				if ws.order[idx] == id {
+					ws.order = append(ws.order[:idx:idx], ws.order[idx+1:]...)
+					break
+				}
+			}
+		})
+	}
+}
+
+// notify 调用所有的回调, 回调在锁外调用, 所以它可以取消自己
+func (ws *WatchedStorage) notify(change Change) {
+	ws.mu.RLock()
+	watchers := make([]func(Change), 0, len(ws.order))
+	for _, id := range ws.order {
+		watchers = append(watchers, ws.watchers[id])
+	}
+	ws.mu.RUnlock()
+
+	for _, fn := range watchers {
+		fn(change)
+	}
+}
+
+func (ws *WatchedStorage) Set(name string, tags []KeyValue, isSingleValue bool, t time.Time, table Table, err error) error {
+	if e := ws.Storage.Set(name, tags, isSingleValue, t, table, err); e != nil {
+		return e
+	}
+	copyed := KeyValues(CloneKeyValues(tags))
+	sort.Sort(copyed)
+	ws.notify(Change{Op: ChangeSet, Table: name, Tags: copyed, Time: t})
+	return nil
+}
+
+func (ws *WatchedStorage) Delete(tablename string, tags []KeyValue) bool {
+	if !ws.Storage.Delete(tablename, tags) {
+		return false
+	}
+	copyed := KeyValues(CloneKeyValues(tags))
+	sort.Sort(copyed)
+	ws.notify(Change{Op: ChangeDelete, Table: tablename, Tags: copyed})
+	return true
+}
+
+func (ws *WatchedStorage) Clear(tablename string) int {
+	count := ws.Storage.Clear(tablename)
+	if count > 0 {
+		ws.notify(Change{Op: ChangeClear, Table: tablename})
+	}
+	return count
+}
+
+func (ws *WatchedStorage) Stats() StorageStats {
+	if s, ok := ws.Storage.(StatsStorage); ok {
+		return s.Stats()
+	}
+	return StorageStats{}
+}
+
+func (ws *WatchedStorage) SetSchema(tablename string, schema *Schema) error {
+	if s, ok := ws.Storage.(SchemaStorage); ok {
+		return s.SetSchema(tablename, schema)
+	}
+	return errors.New("storage isn't support schema")
+}
+
+func (ws *WatchedStorage) Schema(tablename string) (*Schema, bool) {
+	if s, ok := ws.Storage.(SchemaStorage); ok {
+		return s.Schema(tablename)
+	}
+	return nil, false
+}
@@ -41,5 +41,14 @@ func (q Query) ToReference() *ReferenceQuery {
 			return
 		}
 	}
+	if q.Batches != nil {
+		query.Batches = func() ([]Batch, error) {
+			// 复制时数据只读取一次, 不能再按列读取
+			if query.IsCopy {
+				return nil, ErrNoBatches
+			}
+			return q.Batches()
+		}
+	}
 	return query
 }
@@ -58,7 +58,7 @@ func (q Query) Union(q2 Query) Query {
 // returns all the original elements in the input sequences. The Union method
 // returns only unique elements.
 func (q Query) UnionAll(q2 Query) Query {
-	return Query{
+	query := Query{
 		Iterate: func() Iterator {
 			next1 := q.Iterate()
 			next2 := q2.Iterate()
@@ -82,4 +82,18 @@ func (q Query) UnionAll(q2 Query) Query {
 			}
 		},
 	}
+	if q.Batches != nil && q2.Batches != nil {
+		query.Batches = func() ([]Batch, error) {
+			batches1, err := q.Batches()
+			if err != nil {
+				return nil, err
+			}
+			batches2, err := q2.Batches()
+			if err != nil {
+				return nil, err
+			}
+			return append(batches1, batches2...), nil
+		}
+	}
+	return query
 }
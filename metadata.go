@@ -0,0 +1,361 @@
+package memsql
+
+import (
+	"database/sql"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/memsql/memcore"
+	"github.com/runner-mei/memsql/vm"
+)
+
+// MetadataStorage 是可以列出表, tag 集和列的 Storage, SHOW 和 DESCRIBE 语句依赖它
+type MetadataStorage interface {
+	Tables(ctx *SessionContext) ([]string, error)
+	TagSets(ctx *SessionContext, tableName string) ([]memcore.KeyValues, error)
+	Columns(ctx *SessionContext, tableName string) ([]string, error)
+}
+
+// ForeignMetadata 是可以列出表和列的 Foreign
+type ForeignMetadata interface {
+	Tables(ctx *SessionContext) ([]string, error)
+	Columns(ctx *SessionContext, tableName string) ([]string, error)
+}
+
+func (s storageWrapper) Tables(ctx *SessionContext) ([]string, error) {
+	return s.storage.Tables(), nil
+}
+
+func (s storageWrapper) TagSets(ctx *SessionContext, tableName string) ([]memcore.KeyValues, error) {
+	return s.storage.TagSets(tableName)
+}
+
+func (s storageWrapper) Columns(ctx *SessionContext, tableName string) ([]string, error) {
+	return storageColumns(s.storage, tableName)
+}
+
+func (hs *HookStorage) Tables(ctx *SessionContext) ([]string, error) {
+	return hs.Storage.Tables(), nil
+}
+
+// TagSets 返回表的所有 tag 集, ListTags 不为 nil 时使用它, 否则只返回已读取的 tag 集
+func (hs *HookStorage) TagSets(ctx *SessionContext, tableName string) ([]memcore.KeyValues, error) {
+	if hs.ListTags == nil {
+		return hs.Storage.TagSets(tableName)
+	}
+	tagsList, err := hs.ListTags(ctx, tableName)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]memcore.KeyValues, len(tagsList))
+	for idx := range tagsList {
+		results[idx] = memcore.KeyValues(tagsList[idx])
+	}
+	return results, nil
+}
+
+func (hs *HookStorage) Columns(ctx *SessionContext, tableName string) ([]string, error) {
+	return storageColumns(hs.Storage, tableName)
+}
+
+// storageColumns 返回表中所有 measurement 的列, 按第一次出现的顺序排列
+func storageColumns(s memcore.Storage, tableName string) ([]string, error) {
+	list, err := s.From(tableName, func(memcore.TableName) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name.Tags.ToKey() < list[j].Name.Tags.ToKey()
+	})
+
+	var names []string
+	seen := map[string]struct{}{}
+	for _, m := range list {
+		for _, column := range m.Data.Columns {
+			if _, ok := seen[column.Name]; ok {
+				continue
+			}
+			seen[column.Name] = struct{}{}
+			names = append(names, column.Name)
+		}
+	}
+	return names, nil
+}
+
+func (f *dbForeign) Tables(ctx *SessionContext) ([]string, error) {
+	var sqlstr string
+	switch f.Drv {
+	case "sqlite3":
+		sqlstr = "SELECT name FROM sqlite_master WHERE type IN ('table', 'view') AND name NOT LIKE 'sqlite_%' ORDER BY name"
+	case "mysql":
+		sqlstr = "SELECT table_name FROM information_schema.tables WHERE table_schema = database() ORDER BY table_name"
+	default:
+		sqlstr = "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() ORDER BY table_name"
+	}
+
+	rows, err := f.Conn.QueryContext(ctx.Ctx, sqlstr)
+	if err != nil {
+		return nil, wrap(err, "execute '"+sqlstr+"' fail")
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name sql.NullString
+		if err := rows.Scan(&name); err != nil {
+			return nil, wrap(err, "execute '"+sqlstr+"' fail")
+		}
+		names = append(names, name.String)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrap(err, "execute '"+sqlstr+"' fail")
+	}
+	return names, nil
+}
+
+func (f *dbForeign) Columns(ctx *SessionContext, tableName string) ([]string, error) {
+	sqlstr := "SELECT * FROM " + f.quoteIdent(tableName) + " WHERE 1 = 0"
+	rows, err := f.Conn.QueryContext(ctx.Ctx, sqlstr)
+	if err != nil {
+		return nil, wrap(err, "execute '"+sqlstr+"' fail")
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, wrap(err, "execute '"+sqlstr+"' fail")
+	}
+	return names, nil
+}
+
+// quoteIdent 按数据库的语法给表名加上引号, Tables 返回的表名中可能有空格和关键字
+func (f *dbForeign) quoteIdent(name string) string {
+	if f.Drv == "mysql" {
+		return "`" + strings.Replace(name, "`", "``", -1) + "`"
+	}
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// 元数据的类型, 见 describeTable
+const (
+	KindTag    = "tag"
+	KindColumn = "column"
+	KindPseudo = "pseudo"
+)
+
+// 表的来源, 见 showTables
+const (
+	SourceStorage = "storage"
+	SourceForeign = "fdw"
+)
+
+func newMetaTable(names ...string) memcore.Table {
+	columns := make([]memcore.Column, len(names))
+	for idx := range names {
+		columns[idx] = memcore.Column{Name: names[idx]}
+	}
+	return memcore.Table{Columns: columns}
+}
+
+func addMetaRecord(table *memcore.Table, values ...string) {
+	record := make([]memcore.Value, len(values))
+	for idx := range values {
+		record[idx] = vm.StringToValue(values[idx])
+	}
+	table.Records = append(table.Records, record)
+}
+
+func (sc *SessionContext) metadataStorage() (MetadataStorage, error) {
+	ms, ok := sc.Storage.(MetadataStorage)
+	if !ok {
+		return nil, errors.New("storage doesnot support metadata")
+	}
+	return ms, nil
+}
+
+// splitForeignTable 判断表名是否是 fdw.xxx 形式的外部表
+func splitForeignTable(tableName string) (string, bool) {
+	if strings.HasPrefix(tableName, SourceForeign+".") {
+		return strings.TrimPrefix(tableName, SourceForeign+"."), true
+	}
+	return tableName, false
+}
+
+// showTables 返回所有的表, 列为 name 和 source, 外部表的 name 为 fdw.xxx
+func showTables(ctx *SessionContext) (memcore.Table, error) {
+	table := newMetaTable("name", "source")
+
+	ms, err := ctx.metadataStorage()
+	if err != nil {
+		return memcore.Table{}, err
+	}
+	names, err := ms.Tables(ctx)
+	if err != nil {
+		return memcore.Table{}, err
+	}
+	for _, name := range names {
+		addMetaRecord(&table, name, SourceStorage)
+	}
+
+	if fm, ok := ctx.Foreign.(ForeignMetadata); ok {
+		names, err := fm.Tables(ctx)
+		if err != nil {
+			return memcore.Table{}, err
+		}
+		for _, name := range names {
+			addMetaRecord(&table, SourceForeign+"."+name, SourceForeign)
+		}
+	}
+	return table, nil
+}
+
+// tagKeys 返回表的所有 tag 名, 按名称排列
+func tagKeys(tagsList []memcore.KeyValues) []string {
+	seen := map[string]struct{}{}
+	var keys []string
+	for _, tags := range tagsList {
+		for _, tag := range tags {
+			if _, ok := seen[tag.Key]; ok {
+				continue
+			}
+			seen[tag.Key] = struct{}{}
+			keys = append(keys, tag.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// showTagKeys 返回表的所有 tag 名, 列为 tag_key
+func showTagKeys(ctx *SessionContext, tableName string) (memcore.Table, error) {
+	ms, err := ctx.metadataStorage()
+	if err != nil {
+		return memcore.Table{}, err
+	}
+	tagsList, err := ms.TagSets(ctx, tableName)
+	if err != nil {
+		return memcore.Table{}, err
+	}
+
+	table := newMetaTable("tag_key")
+	for _, key := range tagKeys(tagsList) {
+		addMetaRecord(&table, key)
+	}
+	return table, nil
+}
+
+// showTagValues 返回表中名为 key 的 tag 的所有值, 列为 key 和 value
+func showTagValues(ctx *SessionContext, tableName, key string) (memcore.Table, error) {
+	ms, err := ctx.metadataStorage()
+	if err != nil {
+		return memcore.Table{}, err
+	}
+	tagsList, err := ms.TagSets(ctx, tableName)
+	if err != nil {
+		return memcore.Table{}, err
+	}
+
+	seen := map[string]struct{}{}
+	var values []string
+	for _, tags := range tagsList {
+		value, ok := tags.Get(key)
+		if !ok {
+			continue
+		}
+		if _, ok := seen[value]; ok {
+			continue
+		}
+		seen[value] = struct{}{}
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	table := newMetaTable("key", "value")
+	for _, value := range values {
+		addMetaRecord(&table, key, value)
+	}
+	return table, nil
+}
+
+// describeTable 返回表的 tag, 伪列和列, 列为 name 和 kind
+func describeTable(ctx *SessionContext, tableName string) (memcore.Table, error) {
+	table := newMetaTable("name", "kind")
+
+	if name, ok := splitForeignTable(tableName); ok {
+		fm, ok := ctx.Foreign.(ForeignMetadata)
+		if !ok {
+			return memcore.Table{}, errors.New("foreign doesnot support metadata")
+		}
+		columns, err := fm.Columns(ctx, name)
+		if err != nil {
+			return memcore.Table{}, err
+		}
+		for _, column := range columns {
+			addMetaRecord(&table, column, KindColumn)
+		}
+		return table, nil
+	}
+
+	ms, err := ctx.metadataStorage()
+	if err != nil {
+		return memcore.Table{}, err
+	}
+	tagsList, err := ms.TagSets(ctx, tableName)
+	if err != nil {
+		return memcore.Table{}, err
+	}
+	for _, key := range tagKeys(tagsList) {
+		addMetaRecord(&table, "@"+key, KindTag)
+	}
+	for _, name := range []string{memcore.PseudoTime, memcore.PseudoErr, memcore.PseudoTable} {
+		addMetaRecord(&table, name, KindPseudo)
+	}
+	columns, err := ms.Columns(ctx, tableName)
+	if err != nil && !errors.Is(err, errors.ErrTableNotExists) {
+		return memcore.Table{}, err
+	}
+	for _, column := range columns {
+		addMetaRecord(&table, column, KindColumn)
+	}
+	return table, nil
+}
+
+var (
+	metaIdent = "`?([a-zA-Z_][a-zA-Z0-9_.]*)`?"
+
+	showTablesPattern    = regexp.MustCompile(`(?i)^\s*show\s+tables\s*;?\s*$`)
+	showTagKeysPattern   = regexp.MustCompile(`(?i)^\s*show\s+tag\s+keys\s+from\s+` + metaIdent + `\s*;?\s*$`)
+	showTagValuesPattern = regexp.MustCompile(`(?i)^\s*show\s+tag\s+values\s+from\s+` + metaIdent + `\s+with\s+key\s*=\s*(?:'([^']*)'|"([^"]*)"|` + metaIdent + `)\s*;?\s*$`)
+	describePattern      = regexp.MustCompile(`(?i)^\s*(?:describe|desc)\s+` + metaIdent + `\s*;?\s*$`)
+)
+
+// executeMetadata 执行 SHOW TABLES, SHOW TAG KEYS FROM xxx, SHOW TAG VALUES FROM xxx WITH KEY = xxx
+// 和 DESCRIBE xxx 语句, sqlstmt 不是这些语句时返回 false
+func executeMetadata(ctx *SessionContext, sqlstmt string) (RecordSet, bool, error) {
+	var table memcore.Table
+	var err error
+	if showTablesPattern.MatchString(sqlstmt) {
+		table, err = showTables(ctx)
+	} else if m := showTagKeysPattern.FindStringSubmatch(sqlstmt); m != nil {
+		table, err = showTagKeys(ctx, m[1])
+	} else if m := showTagValuesPattern.FindStringSubmatch(sqlstmt); m != nil {
+		table, err = showTagValues(ctx, m[1], m[2]+m[3]+m[4])
+	} else if m := describePattern.FindStringSubmatch(sqlstmt); m != nil {
+		table, err = describeTable(ctx, m[1])
+	} else {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+
+	results := make(RecordSet, 0, table.Length())
+	for idx := 0; idx < table.Length(); idx++ {
+		results = append(results, table.At(idx))
+	}
+	return results, true, nil
+}
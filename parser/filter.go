@@ -257,7 +257,7 @@ func ToGetValue(ctx FilterContext, expr sqlparser.Expr) (func(vm.Context) (vm.Va
 		}, nil
 	case *sqlparser.ColName:
 		var name = strings.ToLower(v.Name.String())
-		if strings.HasPrefix(name, "@") {
+		if strings.HasPrefix(name, "@") && !memcore.IsPseudoColumn(name) {
 			name = strings.TrimPrefix(name, "@")
 		}
 		var tableName = strings.ToLower(v.Qualifier.Name.String())
@@ -1,6 +1,8 @@
 package parser
 
 import (
+	"sort"
+
 	"github.com/runner-mei/memsql/memcore"
 	"github.com/runner-mei/memsql/vm"
 )
@@ -27,11 +29,17 @@ type kvList struct {
 	index int
 }
 
+// KeyValueList 返回按顺序遍历 list 的 KeyValueIterator
+func KeyValueList(list [][]memcore.KeyValue) KeyValueIterator {
+	return &kvList{list: list}
+}
+
 func (kl *kvList) Next(ctx vm.Context) ([]memcore.KeyValue, error) {
-	if len(kl.list) >= kl.index {
+	if kl.index >= len(kl.list) {
 		return nil, memcore.ErrNoRows
 	}
-	return kl.list[kl.index], nil
+	kl.index++
+	return kl.list[kl.index-1], nil
 }
 
 type simpleKv struct {
@@ -95,6 +103,52 @@ func (merge *mergeIterator) Next(ctx vm.Context) ([]memcore.KeyValue, error) {
 	return items, nil
 }
 
+// unionIterator 依次返回各个 iterator 中的 tag 集, 重复的 tag 集只返回一次
+type unionIterator struct {
+	iters []KeyValueIterator
+	index int
+	seen  map[string]struct{}
+}
+
+func unionKeyValues(iters ...KeyValueIterator) KeyValueIterator {
+	var list []KeyValueIterator
+	for _, iter := range iters {
+		if u, ok := iter.(*unionIterator); ok && u.index == 0 && u.seen == nil {
+			list = append(list, u.iters...)
+		} else {
+			list = append(list, iter)
+		}
+	}
+	return &unionIterator{iters: list}
+}
+
+func (u *unionIterator) Next(ctx vm.Context) ([]memcore.KeyValue, error) {
+	if u.seen == nil {
+		u.seen = map[string]struct{}{}
+	}
+	for u.index < len(u.iters) {
+		kvs, err := u.iters[u.index].Next(ctx)
+		if err != nil {
+			if !memcore.IsNoRows(err) {
+				return nil, err
+			}
+			u.index++
+			continue
+		}
+
+		sorted := make(memcore.KeyValues, len(kvs))
+		copy(sorted, kvs)
+		sort.Sort(sorted)
+		key := sorted.ToKey()
+		if _, ok := u.seen[key]; ok {
+			continue
+		}
+		u.seen[key] = struct{}{}
+		return kvs, nil
+	}
+	return nil, memcore.ErrNoRows
+}
+
 func appendKeyValueIterator(query KeyValueIterator, kv ...memcore.KeyValue) KeyValueIterator {
 	if query == nil {
 		return &simpleKv{values: kv, readable: true}
@@ -12,31 +12,77 @@ import (
 type TableAlias = memcore.TableAlias
 
 
+// errNotEnumerable 表示 expr 中有不能枚举的 tag 条件
+var errNotEnumerable = errors.New("tag condition isnot enumerable")
+
+// ToKeyValues 从 expr 中提取 alias 的 tag 集, 返回的 tag 集只会比 expr 匹配的多, 不会少
+//
+// AND 的两边取交集, OR 的两边取并集. 返回 nil 时表示不能从 expr 得到 tag 集, 这时调用者
+// 需要枚举表的所有 tag 集并用 expr 过滤它们, 有两种情况: expr 没有约束 tag, 或者 expr 中
+// 有不能枚举的 tag 条件(如 LIKE, NOT IN, 范围比较). 后者如 @mo=1 and @region like 'cn-%',
+// 只取出 {mo=1} 会漏掉 region, 所以整个 expr 都不能枚举
 func ToKeyValues(fctx FilterContext, expr sqlparser.Expr, alias TableAlias, results KeyValueIterator) (KeyValueIterator, error) {
+	iter, err := toKeyValues(fctx, expr, alias, results)
+	if err != nil {
+		if err == errNotEnumerable {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return iter, nil
+}
+
+// hasTableTag 判断 expr 中是否引用了 alias 的 tag
+func hasTableTag(expr sqlparser.SQLNode, alias TableAlias) bool {
+	filter := ByTableTag(alias)
+	found := false
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if colName, ok := node.(*sqlparser.ColName); ok && filter.filter(colName) {
+			found = true
+		}
+		return !found, nil
+	}, expr)
+	return found
+}
+
+func toKeyValues(fctx FilterContext, expr sqlparser.Expr, alias TableAlias, results KeyValueIterator) (KeyValueIterator, error) {
 	if expr == nil {
 		return nil, nil
 	}
 	switch v := expr.(type) {
 	case *sqlparser.AndExpr:
-		tmp, err := ToKeyValues(fctx, v.Left, alias, results)
+		tmp, err := toKeyValues(fctx, v.Left, alias, results)
 		if err != nil {
 			return nil, err
 		}
-		tmp, err = ToKeyValues(fctx, v.Right, alias, tmp)
+		tmp, err = toKeyValues(fctx, v.Right, alias, tmp)
 		if err != nil {
 			return nil, err
 		}
 		return tmp, nil
-	// case *sqlparser.OrExpr:
-	// 	leftFilter, err := ToFilter(ctx, v.Left)
-	// 	if err != nil {
-	// 		return nil, err
-	// 	}
-	// 	rightFilter, err := ToFilter(ctx, v.Right)
-	// 	if err != nil {
-	// 		return nil, err
-	// 	}
-	// 	return vm.Or(leftFilter, rightFilter), nil
+	case *sqlparser.OrExpr:
+		left, err := toKeyValues(fctx, v.Left, alias, nil)
+		if err != nil {
+			return nil, err
+		}
+		// 两边都要检查是否有不能枚举的 tag 条件
+		right, err := toKeyValues(fctx, v.Right, alias, nil)
+		if err != nil {
+			return nil, err
+		}
+		if left == nil || right == nil {
+			// 有一边没有约束 tag 时, 整个 OR 也没有约束
+			return results, nil
+		}
+
+		iter := unionKeyValues(left, right)
+		if results == nil {
+			return iter, nil
+		}
+		return &mergeIterator{
+			query1: results,
+			query2: iter,
+		}, nil
 	// case *sqlparser.NotExpr:
 	// 	f, err := ToFilter(ctx, v.Expr)
 	// 	if err != nil {
@@ -44,7 +90,7 @@ func ToKeyValues(fctx FilterContext, expr sqlparser.Expr, alias TableAlias, resu
 	// 	}
 	// 	return vm.Not(f), nil
 	case *sqlparser.ParenExpr:
-		return ToKeyValues(fctx, v.Expr, alias, results)
+		return toKeyValues(fctx, v.Expr, alias, results)
 	case *sqlparser.ComparisonExpr:
 		if v.Operator == sqlparser.InStr {
 			tableAs, iter, err := ToInKeyValue(fctx, v)
@@ -71,7 +117,11 @@ func ToKeyValues(fctx FilterContext, expr sqlparser.Expr, alias TableAlias, resu
 			}, nil
 		}
 		if v.Operator != sqlparser.EqualStr {
-			return nil, fmt.Errorf("invalid key value expression %+v", expr)
+			// NOT IN, LIKE, 范围比较等不能枚举, 由调用者过滤
+			if hasTableTag(v, alias) {
+				return nil, errNotEnumerable
+			}
+			return results, nil
 		}
 		iter, err := ToEqualValues(fctx, v, alias)
 		if err != nil {
@@ -89,6 +139,12 @@ func ToKeyValues(fctx FilterContext, expr sqlparser.Expr, alias TableAlias, resu
 			query1: results,
 			query2: iter,
 		}, nil
+	case *sqlparser.RangeCond, *sqlparser.NotExpr, *sqlparser.IsExpr:
+		// 不能枚举, 由调用者过滤
+		if hasTableTag(v, alias) {
+			return nil, errNotEnumerable
+		}
+		return results, nil
 		// case *sqlparser.RangeCond:
 		// 	return nil, ErrUnsupportedExpr("RangeCond")
 		// case *sqlparser.IsExpr:
@@ -152,7 +208,7 @@ func ToEqualValues(fctx FilterContext, expr *sqlparser.ComparisonExpr, qualifier
 				return nil, fmt.Errorf("invalid ComparisonExpr, left and right qualifier is same")
 			}
 			leftName := sqlparser.String(left.Name)
-			if !strings.HasPrefix(leftName, "@") {
+			if !isTag(leftName) {
 				return nil, nil
 			}
 
@@ -173,7 +229,7 @@ func ToEqualValues(fctx FilterContext, expr *sqlparser.ComparisonExpr, qualifier
 		}
 		if qualifier.Equal(rightQualifier) {
 			rightName := sqlparser.String(right.Name)
-			if !strings.HasPrefix(rightName, "@") {
+			if !isTag(rightName) {
 				return nil, nil
 			}
 
@@ -206,7 +262,7 @@ func ToEqualValues(fctx FilterContext, expr *sqlparser.ComparisonExpr, qualifier
 		if err != nil {
 			return nil, err
 		}
-		if !strings.HasPrefix(key, "@") {
+		if !isTag(key) {
 			return nil, nil
 		}
 
@@ -227,7 +283,7 @@ func ToEqualValues(fctx FilterContext, expr *sqlparser.ComparisonExpr, qualifier
 		if err != nil {
 			return nil, err
 		}
-		if !strings.HasPrefix(key, "@") {
+		if !isTag(key) {
 			return nil, nil
 		}
 
@@ -261,7 +317,7 @@ func ToInKeyValue(fctx FilterContext, expr *sqlparser.ComparisonExpr) (string, K
 		}
 
 		leftName := left.Name.String()
-		if !strings.HasPrefix(leftName, "@") {
+		if !isTag(leftName) {
 			return "", nil, nil
 		}
 
@@ -277,7 +333,7 @@ func ToInKeyValue(fctx FilterContext, expr *sqlparser.ComparisonExpr) (string, K
 		}
 
 		rightName := right.Name.String()
-		if !strings.HasPrefix(rightName, "@") {
+		if !isTag(rightName) {
 			return "", nil, nil
 		}
 		name := strings.TrimPrefix(rightName, "@")
@@ -4,13 +4,19 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/runner-mei/memsql/memcore"
 	"github.com/xwb1989/sqlparser"
 )
 
+// isTag 判断列名是不是 tag, 伪列(如 @_time)不是 tag
+func isTag(name string) bool {
+	return strings.HasPrefix(name, "@") && !memcore.IsPseudoColumn(strings.ToLower(name))
+}
+
 func ByTag() ExprFilter {
 	return ExprFilter{
 			filter: func(expr *sqlparser.ColName) bool {
-		return strings.HasPrefix(expr.Name.String(), "@")
+		return isTag(expr.Name.String())
 	},
 }
 }
@@ -19,12 +25,12 @@ func ByTableTag(tableAs TableAlias) ExprFilter {
 	return ExprFilter{
 			filter:  func(expr *sqlparser.ColName) bool {
 		if expr.Qualifier.IsEmpty() {
-			return strings.HasPrefix(expr.Name.String(), "@")
+			return isTag(expr.Name.String())
 		}
 
 		qualifier := strings.ToLower(sqlparser.String(expr.Qualifier));
 		if tableAs.Equal(qualifier){
-			return strings.HasPrefix(expr.Name.String(), "@")
+			return isTag(expr.Name.String())
 		}
 		return false
 	},
@@ -63,6 +69,12 @@ func (ef *ExprFilter) TableFilter() {
 	ef.isTableFilter  = true
 }
 
+// SplitBy 从 expr 中取出只引用 filter 所接受的列的条件, 返回的条件是 expr 的必要条件,
+// 即 expr 为真时它一定为真, 所以可以用它提前过滤单个表的数据
+//
+// 对于 OR, 只有两边都能取出条件时才取两边条件的 OR, 如
+// (b.c=1 and a.b = 2) or (b.d = 2 and a.b = 3) 对 a 取出 (a.b = 2) or (a.b = 3),
+// 而 b.c=1 or a.b = 2 对 a 什么也取不出来
 func SplitBy(expr sqlparser.Expr, filter ExprFilter) (bool, sqlparser.Expr, error) {
 	switch v := expr.(type) {
 	case *sqlparser.AndExpr:
@@ -96,11 +108,9 @@ func SplitBy(expr sqlparser.Expr, filter ExprFilter) (bool, sqlparser.Expr, erro
 		if err != nil {
 			return false, nil, err
 		}
-		if left == nil {
-			return true, right, nil
-		}
-		if right == nil {
-			return true, left, nil
+		if left == nil || right == nil {
+			// 有一边对这个表没有约束时, 整个 OR 对这个表也没有约束
+			return true, nil, nil
 		}
 		if !leftChanged && !rightChanged {
 			return false, expr, nil
@@ -114,13 +124,11 @@ func SplitBy(expr sqlparser.Expr, filter ExprFilter) (bool, sqlparser.Expr, erro
 		if err != nil {
 			return false, nil, err
 		}
-		if x == nil {
+		if x == nil || changed {
+			// NOT 会反转条件, 去掉一部分条件后再取反就不再是必要条件了
 			return true, nil, nil
 		}
-		if !changed {
-			return false, expr, err
-		}
-		return true, &sqlparser.NotExpr{Expr: x}, nil
+		return false, expr, err
 	case *sqlparser.ParenExpr:
 		changed, x, err := SplitBy(v.Expr, filter)
 		if err != nil {
@@ -29,7 +29,7 @@ func TestSplitByName(t *testing.T) {
 		{
 			s: "select a from a where a.a = b.b and (b.c=1 or (b.d = 2 and a.b = 2)) and b.e = 3",
 			results: map[string]string{
-				"a": "((a.b = 2))",
+				"a": "",
 				"b": "(b.c = 1 or (b.d = 2)) and b.e = 3",
 			},
 		},
@@ -40,6 +40,27 @@ func TestSplitByName(t *testing.T) {
 				"b": "((b.c = 1) or (b.d = 2)) and b.e = 3",
 			},
 		},
+		{
+			s: "select a from a where a.a = b.b and (a.b = 2 or b.c = 1)",
+			results: map[string]string{
+				"a": "",
+				"b": "",
+			},
+		},
+		{
+			s: "select a from a where a.a = b.b and ((a.b = 2 and b.c = 1) or (a.b = 3 and b.c in (2, 3) and b.d = 4)) and a.e = 3",
+			results: map[string]string{
+				"a": "((a.b = 2) or (a.b = 3)) and a.e = 3",
+				"b": "((b.c = 1) or (b.c in (2, 3) and b.d = 4))",
+			},
+		},
+		{
+			s: "select a from a where a.a = b.b and not (a.b = 2 and b.c = 1) and not (b.d = 4)",
+			results: map[string]string{
+				"a": "",
+				"b": "not (b.d = 4)",
+			},
+		},
 	} {
 		stmt, err := sqlparser.Parse(test.s)
 		if err != nil {
@@ -50,7 +71,7 @@ func TestSplitByName(t *testing.T) {
 		sel, _ := stmt.(*sqlparser.Select)
 
 		for key, txt := range test.results {
-			expr, err := SplitByTableName(sel.Where.Expr, key)
+			expr, err := SplitByTableName(sel.Where.Expr, key, "")
 			if err != nil {
 				t.Error(test.s)
 				t.Error(err)
@@ -0,0 +1,178 @@
+package memsql
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/runner-mei/memsql/memcore"
+)
+
+type hotTags struct {
+	tableName string
+	tags      []memcore.KeyValue
+	hits      int
+}
+
+// refresher 管理 HookStorage 的后台读取, 包括过期数据的刷新和热点 tag 集的主动刷新
+type refresher struct {
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+	hot    map[string]*hotTags
+}
+
+func (r *refresher) init() {
+	r.once.Do(func() {
+		r.ctx, r.cancel = context.WithCancel(context.Background())
+	})
+}
+
+func (r *refresher) hit(tableName string, tags []memcore.KeyValue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.hot == nil {
+		return
+	}
+	key := readKey(tableName, tags)
+	if e, ok := r.hot[key]; ok {
+		e.hits++
+		return
+	}
+	// tags 可能和其它 tag 集共享底层数组(见 mergeIterator), 需要复制一份
+	r.hot[key] = &hotTags{
+		tableName: tableName,
+		tags:      memcore.KeyValues(memcore.CloneKeyValues(tags)),
+		hits:      1,
+	}
+}
+
+// forget 删除 key 满足 match 的热点记录
+func (r *refresher) forget(match func(key, tableName string) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, e := range r.hot {
+		if match(key, e.tableName) {
+			delete(r.hot, key)
+		}
+	}
+}
+
+// takeHot 返回本周期内查询次数达到 threshold 的 tag 集, 并开始一个新的周期
+func (r *refresher) takeHot(threshold int) []hotTags {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var list []hotTags
+	for key, e := range r.hot {
+		if e.hits == 0 {
+			delete(r.hot, key)
+			continue
+		}
+		if e.hits >= threshold {
+			list = append(list, *e)
+		}
+		e.hits = 0
+	}
+	return list
+}
+
+// Start 启动后台任务, 每隔 interval 主动刷新将要过期的热点 tag 集
+func (hs *HookStorage) Start(interval time.Duration) {
+	hs.refresh.init()
+
+	hs.refresh.mu.Lock()
+	if hs.refresh.hot == nil {
+		hs.refresh.hot = map[string]*hotTags{}
+	}
+	hs.refresh.mu.Unlock()
+
+	hs.refresh.wg.Add(1)
+	go func() {
+		defer hs.refresh.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-hs.refresh.ctx.Done():
+				return
+			case <-ticker.C:
+				hs.refreshHot(interval)
+			}
+		}
+	}()
+}
+
+// Close 停止后台任务, 并等待正在进行的后台读取结束
+func (hs *HookStorage) Close() error {
+	hs.refresh.init()
+
+	hs.refresh.mu.Lock()
+	hs.refresh.closed = true
+	hs.refresh.mu.Unlock()
+
+	hs.refresh.cancel()
+	hs.refresh.wg.Wait()
+	return nil
+}
+
+func (hs *HookStorage) refreshHot(interval time.Duration) {
+	threshold := hs.HotThreshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+
+	// 在下一个周期前就会过期的数据现在就读取
+	deadline := time.Now().Add(interval)
+	for _, e := range hs.refresh.takeHot(threshold) {
+		predateLimit, errPredateLimit := hs.Freshness.Get(e.tableName, e.tags).limits(deadline)
+		if hs.Storage.Exists(e.tableName, e.tags, predateLimit, errPredateLimit) {
+			continue
+		}
+		hs.refreshInBackground(e.tableName, e.tags)
+	}
+}
+
+// refreshInBackground 在后台读取 tag 集, 同一个 tag 集正在读取时什么也不做
+func (hs *HookStorage) refreshInBackground(tableName string, tags []memcore.KeyValue) {
+	hs.refresh.init()
+
+	key := readKey(tableName, tags)
+	if hs.breakers.allow(hs.Breaker, key, time.Now()) != nil {
+		return
+	}
+
+	hs.refresh.mu.Lock()
+	if hs.refresh.closed {
+		hs.refresh.mu.Unlock()
+		return
+	}
+	hs.refresh.wg.Add(1)
+	hs.refresh.mu.Unlock()
+
+	started := hs.reads.Go(key, func() (interface{}, error) {
+		defer hs.refresh.wg.Done()
+
+		ctx := &SessionContext{
+			Context: &Context{
+				Ctx:     hs.refresh.ctx,
+				Storage: hs,
+			},
+			alias:      map[string]string{},
+			resultSets: map[string][]memcore.Record{},
+		}
+		defer ctx.Close()
+		return hs.readAndSave(ctx, key, tableName, tags)
+	})
+	if !started {
+		hs.refresh.wg.Done()
+	}
+}
@@ -0,0 +1,229 @@
+package memsql
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/runner-mei/memsql/memcore"
+)
+
+// Retry 是 Read 失败后的重试策略
+type Retry struct {
+	// MaxAttempts 是包括第一次在内最多调用 Read 的次数, 小于等于 1 时不重试
+	MaxAttempts int
+
+	// Backoff 是第一次重试前等待的时间, 之后每次翻倍, 但不超过 MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func (r Retry) nextBackoff(backoff time.Duration) time.Duration {
+	backoff = backoff * 2
+	if r.MaxBackoff > 0 && backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+	return backoff
+}
+
+// RetryPolicy 按表名决定重试策略, Tables 中没有的表使用 Default
+type RetryPolicy struct {
+	Default Retry
+	Tables  map[string]Retry
+}
+
+func (p *RetryPolicy) Get(tableName string) Retry {
+	if r, ok := p.Tables[tableName]; ok {
+		return r
+	}
+	return p.Default
+}
+
+// BreakerPolicy 是 tag 集的熔断策略, 同一个 tag 集连续读取失败 FailureThreshold 次后
+// 熔断器断开, 在 OpenTimeout 内不再调用 Read
+type BreakerPolicy struct {
+	// FailureThreshold 为 0 时不启用熔断
+	FailureThreshold int
+	OpenTimeout      time.Duration
+}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerStat 是一个 tag 集的熔断器状态
+type BreakerStat struct {
+	Table     string
+	Tags      []memcore.KeyValue
+	State     BreakerState
+	Failures  int
+	LastError error
+	OpenUntil time.Time
+}
+
+// CircuitOpenError 是熔断器断开时读取返回的错误
+type CircuitOpenError struct {
+	BreakerStat
+}
+
+func (e *CircuitOpenError) Error() string {
+	msg := "circuit breaker of '" + e.Table + "(" + memcore.KeyValues(e.Tags).ToKey() + ")' is open until " + e.OpenUntil.Format(time.RFC3339)
+	if e.LastError != nil {
+		msg += ": " + e.LastError.Error()
+	}
+	return msg
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return e.LastError
+}
+
+type breakers struct {
+	mu   sync.Mutex
+	list map[string]*BreakerStat
+}
+
+// allow 判断是否可以读取, 熔断器断开时返回 CircuitOpenError
+func (b *breakers) allow(policy BreakerPolicy, key string, now time.Time) error {
+	if policy.FailureThreshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stat, ok := b.list[key]
+	if !ok || stat.State == BreakerClosed {
+		return nil
+	}
+	if stat.State == BreakerOpen {
+		if now.Before(stat.OpenUntil) {
+			return &CircuitOpenError{BreakerStat: *stat}
+		}
+		stat.State = BreakerHalfOpen
+	}
+	return nil
+}
+
+func (b *breakers) done(policy BreakerPolicy, key, tableName string, tags []memcore.KeyValue, err error, now time.Time) {
+	if policy.FailureThreshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stat, ok := b.list[key]
+	if err == nil {
+		if ok {
+			delete(b.list, key)
+		}
+		return
+	}
+
+	if !ok {
+		if b.list == nil {
+			b.list = map[string]*BreakerStat{}
+		}
+		stat = &BreakerStat{
+			Table: tableName,
+			Tags:  append([]memcore.KeyValue(nil), tags...),
+		}
+		b.list[key] = stat
+	}
+	stat.Failures++
+	stat.LastError = err
+	if stat.State == BreakerHalfOpen || stat.Failures >= policy.FailureThreshold {
+		stat.State = BreakerOpen
+		stat.OpenUntil = now.Add(policy.OpenTimeout)
+	}
+}
+
+func (b *breakers) stats() []BreakerStat {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	results := make([]BreakerStat, 0, len(b.list))
+	for _, stat := range b.list {
+		results = append(results, *stat)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Table != results[j].Table {
+			return results[i].Table < results[j].Table
+		}
+		return memcore.KeyValues(results[i].Tags).ToKey() < memcore.KeyValues(results[j].Tags).ToKey()
+	})
+	return results
+}
+
+// forget 删除 key 满足 match 的熔断器
+func (b *breakers) forget(match func(key, tableName string) bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, stat := range b.list {
+		if match(key, stat.Table) {
+			delete(b.list, key)
+		}
+	}
+}
+
+// BreakerStats 返回所有读取失败过的 tag 集的熔断器状态
+func (hs *HookStorage) BreakerStats() []BreakerStat {
+	return hs.breakers.stats()
+}
+
+// readWithRetry 调用 Read, 失败时按表的重试策略重试
+func (hs *HookStorage) readWithRetry(ctx *SessionContext, tableName string, tags []memcore.KeyValue) (t time.Time, value interface{}, err error) {
+	err = hs.withRetry(ctx, tableName, func() error {
+		t, value, err = hs.readOne(ctx, tableName, tags)
+		return err
+	})
+	return t, value, err
+}
+
+// withRetry 调用 fn, 失败时按表的重试策略重试
+func (hs *HookStorage) withRetry(ctx *SessionContext, tableName string, fn func() error) error {
+	retry := hs.Retry.Get(tableName)
+
+	var done <-chan struct{}
+	if ctx.Ctx != nil {
+		done = ctx.Ctx.Done()
+	}
+
+	backoff := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retry.MaxAttempts {
+			return err
+		}
+
+		if backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-done:
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+			backoff = retry.nextBackoff(backoff)
+		}
+	}
+}
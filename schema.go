@@ -0,0 +1,169 @@
+package memsql
+
+import (
+	"strings"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/memsql/memcore"
+	"github.com/runner-mei/memsql/vm"
+	"github.com/xwb1989/sqlparser"
+)
+
+// TableSchemaProvider 是可以返回表结构的 Storage, 查询前会用表结构检查 where 和聚合函数中列的类型
+type TableSchemaProvider interface {
+	TableSchema(tableName string) (*memcore.Schema, bool)
+}
+
+func (s storageWrapper) TableSchema(tableName string) (*memcore.Schema, bool) {
+	if ss, ok := s.storage.(memcore.SchemaStorage); ok {
+		return ss.Schema(tableName)
+	}
+	return nil, false
+}
+
+// TableSchema 返回表结构, 优先使用 Schemas 中的定义
+func (hs *HookStorage) TableSchema(tableName string) (*memcore.Schema, bool) {
+	if schema := hs.Schemas[tableName]; schema != nil {
+		return schema, true
+	}
+	if ss, ok := hs.Storage.(memcore.SchemaStorage); ok {
+		return ss.Schema(tableName)
+	}
+	return nil, false
+}
+
+func tableSchemaOf(ec *SessionContext, ds Datasource) *memcore.Schema {
+	if ds.Table == "" || strings.EqualFold(ds.Qualifier, InformationSchema) || ds.Qualifier == "fdw" {
+		return nil
+	}
+	ss, ok := ec.Storage.(TableSchemaProvider)
+	if !ok {
+		return nil
+	}
+	schema, ok := ss.TableSchema(ds.Table)
+	if !ok {
+		return nil
+	}
+	return schema
+}
+
+// schemaColumn 返回 column 在 schema 中的定义, column 不属于 ds 或者是 tag 和伪列时返回 nil,
+// hasJoin 为 true 时没有表名的列不能确定属于哪个表, 也返回 nil
+func schemaColumn(schema *memcore.Schema, ds Datasource, column *sqlparser.ColName, hasJoin bool) (*memcore.ColumnSchema, error) {
+	if strings.HasPrefix(column.Name.String(), "@") {
+		return nil, nil
+	}
+	tableName, name := toColumnName(column)
+	if tableName == "" {
+		if hasJoin {
+			return nil, nil
+		}
+	} else if tableName != strings.ToLower(ds.Table) && tableName != strings.ToLower(ds.As) {
+		return nil, nil
+	}
+
+	for idx := range schema.Columns {
+		if strings.ToLower(schema.Columns[idx].Name) == name {
+			return &schema.Columns[idx], nil
+		}
+	}
+	if schema.HasTag(name) || !schema.Strict {
+		return nil, nil
+	}
+	return nil, memcore.ColumnNotFound(ds.Table, name)
+}
+
+// validateWhere 用表结构检查 where 中的列是否存在, 以及和列比较的常量能否转换为列的类型
+func validateWhere(ec *SessionContext, schema *memcore.Schema, ds Datasource, expr sqlparser.Expr, hasJoin bool) error {
+	return sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			// 子查询中的列属于其它的表
+			return false, nil
+		case *sqlparser.ColName:
+			_, err := schemaColumn(schema, ds, n, hasJoin)
+			return false, err
+		case *sqlparser.ComparisonExpr:
+			if err := validateComparison(ec, schema, ds, n.Left, n.Right, hasJoin); err != nil {
+				return false, err
+			}
+			if err := validateComparison(ec, schema, ds, n.Right, n.Left, hasJoin); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}, expr)
+}
+
+func validateComparison(ec *SessionContext, schema *memcore.Schema, ds Datasource, left, right sqlparser.Expr, hasJoin bool) error {
+	colName, ok := left.(*sqlparser.ColName)
+	if !ok {
+		return nil
+	}
+	column, err := schemaColumn(schema, ds, colName, hasJoin)
+	if err != nil || column == nil || column.Type == vm.ValueNull || column.Type == vm.ValueAny {
+		return err
+	}
+
+	var literals []sqlparser.Expr
+	if tuple, ok := right.(sqlparser.ValTuple); ok {
+		literals = tuple
+	} else {
+		literals = []sqlparser.Expr{right}
+	}
+	for _, literal := range literals {
+		value, ok := toBatchLiteral(ec, literal)
+		if !ok || isNumericType(value.Type) && isNumericType(column.Type) {
+			// 数值之间总是可以比较, 如 int 列和 1.5 比较
+			continue
+		}
+		if _, err := memcore.ConvertValue(value, column.Type); err != nil {
+			return errors.Wrap(err, "column '"+column.Name+"' is "+column.Type.String()+", couldn't compare with '"+sqlparser.String(literal)+"'")
+		}
+	}
+	return nil
+}
+
+// validateSelectExprs 用表结构检查 select 中的列是否存在, 以及 sum 和 avg 的参数是否是数值列
+func validateSelectExprs(schema *memcore.Schema, ds Datasource, exprs sqlparser.SelectExprs) error {
+	return sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			return false, nil
+		case *sqlparser.ColName:
+			_, err := schemaColumn(schema, ds, n, false)
+			return false, err
+		case *sqlparser.FuncExpr:
+			name := n.Name.Lowered()
+			if name != "sum" && name != "avg" || len(n.Exprs) != 1 {
+				return true, nil
+			}
+			aliased, ok := n.Exprs[0].(*sqlparser.AliasedExpr)
+			if !ok {
+				return true, nil
+			}
+			colName, ok := aliased.Expr.(*sqlparser.ColName)
+			if !ok {
+				return true, nil
+			}
+			column, err := schemaColumn(schema, ds, colName, false)
+			if err != nil || column == nil {
+				return false, err
+			}
+			switch column.Type {
+			case vm.ValueString, vm.ValueBool, vm.ValueDatetime:
+				return false, errors.New("couldn't " + name + " column '" + column.Name + "' of type " + column.Type.String())
+			}
+			return false, nil
+		}
+		return true, nil
+	}, exprs)
+}
+
+func isNumericType(typ vm.ValueType) bool {
+	switch typ {
+	case vm.ValueInt64, vm.ValueUint64, vm.ValueFloat64:
+		return true
+	}
+	return false
+}
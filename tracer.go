@@ -30,19 +30,32 @@ type ReadInfo struct {
 	Method int
 	Result interface{}
 	Error error
+	Breaker *BreakerStat
 }
 
 const (
 	ReadSkip = 0
 	ReadOk = 1
 	ReadError = 2
+	ReadStale = 3
+	ReadRejected = 4
 )
 
 type ExecuteTracer struct {
 	tables []*TableTracer
 	Results []string
+	// Batches 是按列读取的批数, 为 0 时表示查询是逐行执行的, 按列读取时 Results 中每批只记录一行摘要
+	Batches int
 
 	Reads map[string][]ReadInfo
+
+	// Skipped 是查询中因为读取出错而被跳过的 measurement
+	Skipped []SkipInfo
+}
+
+type SkipInfo struct {
+	Name  memcore.TableName
+	Error error
 }
 
 func (d *ExecuteTracer) String() string {
@@ -76,14 +89,32 @@ func (d *ExecuteTracer) Format(formater Formater) {
 				case ReadError:
 				formater.Println("\t\t\t\t Tags", memcore.KeyValues(record.Tags).ToKey(), "READ ERROR:")
 				formater.Println("\t\t\t\t\t\t", record.Error)
+				case ReadStale:
+				formater.Println("\t\t\t\t Tags", memcore.KeyValues(record.Tags).ToKey(), "STALE, REFRESHING")
+				case ReadRejected:
+				formater.Println("\t\t\t\t Tags", memcore.KeyValues(record.Tags).ToKey(), "CIRCUIT OPEN:")
+				formater.Println("\t\t\t\t\t\t", record.Error)
 				default:
 				formater.Println("\t\t\t\t Tags", memcore.KeyValues(record.Tags).ToKey(), "UNKNOWN")
 				}
 			}
 		}
 	}
+
+	if len(d.Skipped) > 0 {
+		formater.Println("Skipped: ")
+		for idx := range d.Skipped {
+			formater.Println("\t\t\t\t - ", d.Skipped[idx].Name.String(), d.Skipped[idx].Error)
+		}
+	}
 }
 
+func (d *ExecuteTracer) SkipMeasurement(name memcore.TableName, err error) {
+  d.Skipped = append(d.Skipped, SkipInfo{
+  	Name: name,
+  	Error: err,
+  })
+}
 func (d *ExecuteTracer) ReadSkip(tableName string, tags []memcore.KeyValue) {
    if d.Reads == nil {
   	d.Reads = map[string][]ReadInfo{}
@@ -93,6 +124,26 @@ func (d *ExecuteTracer) ReadSkip(tableName string, tags []memcore.KeyValue) {
   	Method: ReadSkip,
   })
 }
+func (d *ExecuteTracer) ReadStale(tableName string, tags []memcore.KeyValue) {
+   if d.Reads == nil {
+  	d.Reads = map[string][]ReadInfo{}
+  }
+  d.Reads[tableName] = append(d.Reads[tableName], ReadInfo{
+  	Tags: tags,
+  	Method: ReadStale,
+  })
+}
+func (d *ExecuteTracer) ReadRejected(tableName string, tags []memcore.KeyValue, err *CircuitOpenError) {
+  if d.Reads == nil {
+  	d.Reads = map[string][]ReadInfo{}
+  }
+  d.Reads[tableName] = append(d.Reads[tableName], ReadInfo{
+  	Tags: tags,
+  	Method: ReadRejected,
+  	Error: err,
+  	Breaker: &err.BreakerStat,
+  })
+}
 func (d *ExecuteTracer) ReadOk(tableName string, tags []memcore.KeyValue, value interface{}) {
    if d.Reads == nil {
   	d.Reads = map[string][]ReadInfo{}
@@ -115,9 +166,13 @@ func (d *ExecuteTracer) ReadError(tableName string, tags []memcore.KeyValue, err
 }
 
 func (d *ExecuteTracer) Track(query memcore.Query) memcore.Query {
-	return query.Map(func(ctx memcore.Context, r memcore.Record) (memcore.Record, error) {
+	return query.MapBatches(func(ctx memcore.Context, r memcore.Record) (memcore.Record, error) {
 		d.Results = append(d.Results, r.GoString())
 		return r, nil
+	}, func(b memcore.Batch) (memcore.Batch, error) {
+		d.Batches++
+		d.Results = appendBatch(d.Results, b)
+		return b, nil
 	})
 }
 
@@ -140,6 +195,8 @@ type TableTracer struct {
 	Where       string
 
 	Results []string
+	// Batches 是按列读取的批数, 为 0 时表示查询是逐行执行的, 按列读取时 Results 中每批只记录一行摘要
+	Batches int
 }
 
 func (d *TableTracer) SetTableNames(tableNames []memcore.TableName) {
@@ -153,9 +210,13 @@ func (d *TableTracer) SetWhere(expr sqlparser.Expr) {
 }
 
 func (d *TableTracer) Track(query memcore.Query) memcore.Query {
-	return query.Map(func(ctx memcore.Context, r memcore.Record) (memcore.Record, error) {
+	return query.MapBatches(func(ctx memcore.Context, r memcore.Record) (memcore.Record, error) {
 		d.Results = append(d.Results, r.GoString())
 		return r, nil
+	}, func(b memcore.Batch) (memcore.Batch, error) {
+		d.Batches++
+		d.Results = appendBatch(d.Results, b)
+		return b, nil
 	})
 }
 
@@ -183,4 +244,14 @@ func (d *TableTracer) Format(formater Formater) {
 	for idx := range d.Results {
 		formater.Println("\t\t\t\t - ", d.Results[idx])
 	}
-}
\ No newline at end of file
+}
+
+// appendBatch 将按列读取的一批数据的摘要(tag 集, 行数和列名)加到 results 中,
+// 不逐行记录, 以免跟踪的开销抵消按列执行的好处
+func appendBatch(results []string, b memcore.Batch) []string {
+	names := make([]string, len(b.Table.Columns))
+	for idx, column := range b.Table.Columns {
+		names[idx] = column.Name
+	}
+	return append(results, fmt.Sprintf("batch %s: %d rows, columns [%s]", b.Tags.ToKey(), b.Length(), strings.Join(names, ", ")))
+}
@@ -0,0 +1,489 @@
+package memsql
+
+import (
+	"strings"
+
+	"github.com/runner-mei/errors"
+	"github.com/runner-mei/memsql/memcore"
+	"github.com/runner-mei/memsql/parser"
+	"github.com/runner-mei/memsql/vm"
+	"github.com/xwb1989/sqlparser"
+)
+
+// 按列执行的过滤和聚合, 查询的数据可以按列读取时(见 memcore.Query.Batches)使用,
+// 结果和按行执行相同, 不能按列执行的表达式仍然按行执行
+
+// batchSelector 从 rows 中选出满足条件的行, rows 中的行号是从小到大排列的
+type batchSelector func(b *memcore.Batch, rows []int) ([]int, error)
+
+func (s batchSelector) selectRows(b memcore.Batch) ([]int, error) {
+	rows := b.Selection
+	if rows == nil {
+		rows = make([]int, b.Table.Length())
+		for idx := range rows {
+			rows[idx] = idx
+		}
+	}
+	return s(&b, rows)
+}
+
+// toBatchSelector 将 where 条件转换为按列执行的过滤函数, 只支持 AND, OR, NOT
+// 和列与常量的比较, 不支持时返回 false
+func toBatchSelector(ec *SessionContext, expr sqlparser.Expr) (batchSelector, bool) {
+	switch v := expr.(type) {
+	case *sqlparser.AndExpr:
+		left, ok := toBatchSelector(ec, v.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := toBatchSelector(ec, v.Right)
+		if !ok {
+			return nil, false
+		}
+		return func(b *memcore.Batch, rows []int) ([]int, error) {
+			matched, err := left(b, rows)
+			if err != nil || len(matched) == 0 {
+				return matched, err
+			}
+			return right(b, matched)
+		}, true
+	case *sqlparser.OrExpr:
+		left, ok := toBatchSelector(ec, v.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := toBatchSelector(ec, v.Right)
+		if !ok {
+			return nil, false
+		}
+		return func(b *memcore.Batch, rows []int) ([]int, error) {
+			matched, err := left(b, rows)
+			if err != nil {
+				return nil, err
+			}
+			rest := exceptRows(rows, matched)
+			if len(rest) == 0 {
+				return matched, nil
+			}
+			more, err := right(b, rest)
+			if err != nil {
+				return nil, err
+			}
+			return mergeRows(matched, more), nil
+		}, true
+	case *sqlparser.NotExpr:
+		f, ok := toBatchSelector(ec, v.Expr)
+		if !ok {
+			return nil, false
+		}
+		return func(b *memcore.Batch, rows []int) ([]int, error) {
+			matched, err := f(b, rows)
+			if err != nil {
+				return nil, err
+			}
+			return exceptRows(rows, matched), nil
+		}, true
+	case *sqlparser.ParenExpr:
+		return toBatchSelector(ec, v.Expr)
+	case *sqlparser.ComparisonExpr:
+		return toBatchComparison(ec, v)
+	}
+	return nil, false
+}
+
+func toBatchComparison(ec *SessionContext, expr *sqlparser.ComparisonExpr) (batchSelector, bool) {
+	switch expr.Operator {
+	case sqlparser.EqualStr, sqlparser.NotEqualStr,
+		sqlparser.LessThanStr, sqlparser.LessEqualStr,
+		sqlparser.GreaterThanStr, sqlparser.GreaterEqualStr:
+	default:
+		return nil, false
+	}
+
+	columnOnLeft := true
+	column, ok := expr.Left.(*sqlparser.ColName)
+	literal := expr.Right
+	if !ok {
+		column, ok = expr.Right.(*sqlparser.ColName)
+		if !ok {
+			return nil, false
+		}
+		literal = expr.Left
+		columnOnLeft = false
+	}
+	value, ok := toBatchLiteral(ec, literal)
+	if !ok {
+		return nil, false
+	}
+
+	op := expr.Operator
+	tableName, name := toColumnName(column)
+	return func(b *memcore.Batch, rows []int) ([]int, error) {
+		vector, constant, err := batchColumn(b, tableName, name, true)
+		if err != nil {
+			return nil, err
+		}
+		if vector == nil {
+			// tag 和伪列在同一批中的值都相同, 只需要比较一次
+			left, right := constant, value
+			if !columnOnLeft {
+				left, right = value, constant
+			}
+			ok, err := compareValues(op, left, right)
+			if err != nil || !ok {
+				return nil, err
+			}
+			return rows, nil
+		}
+		return compareVector(op, vector, value, columnOnLeft, rows)
+	}, true
+}
+
+// toBatchLiteral 读取字符串, 整数和浮点数常量
+func toBatchLiteral(ec *SessionContext, expr sqlparser.Expr) (vm.Value, bool) {
+	v, ok := expr.(*sqlparser.SQLVal)
+	if !ok {
+		return vm.Null(), false
+	}
+	switch v.Type {
+	case sqlparser.StrVal, sqlparser.IntVal, sqlparser.FloatVal:
+	default:
+		return vm.Null(), false
+	}
+	read, err := parser.ToGetValue(ec, v)
+	if err != nil {
+		return vm.Null(), false
+	}
+	value, err := read(nil)
+	if err != nil {
+		return vm.Null(), false
+	}
+	return value, true
+}
+
+// toColumnName 同 parser.ToGetValue 中对列名的处理
+func toColumnName(column *sqlparser.ColName) (string, string) {
+	name := strings.ToLower(column.Name.String())
+	if strings.HasPrefix(name, "@") && !memcore.IsPseudoColumn(name) {
+		name = strings.TrimPrefix(name, "@")
+	}
+	tableName := strings.ToLower(column.Qualifier.Name.String())
+	if tableName == "" {
+		tableName = strings.ToLower(column.Qualifier.Qualifier.String())
+	}
+	return tableName, name
+}
+
+// batchColumn 查找列, 找不到列时查找伪列和 tag, 这时返回的 vector 为 nil, 值为 constant
+func batchColumn(b *memcore.Batch, tableName, name string, withQualifier bool) (*memcore.Vector, vm.Value, error) {
+	if !withQualifier {
+		tableName = ""
+	}
+	idx := b.Table.ColumnIndex(tableName, name)
+	if idx >= 0 {
+		return b.Table.Vectors[idx], vm.Null(), nil
+	}
+	if tableName != "" && !isBatchOf(b, tableName) {
+		// 伪列和 tag 也要属于 tableName 指定的表
+		return nil, vm.Null(), memcore.ColumnNotFound(tableName, name)
+	}
+
+	r := memcore.Record{Tags: b.Tags, Meta: b.Meta}
+	value, ok := r.Get(name)
+	if !ok {
+		return nil, vm.Null(), memcore.ColumnNotFound(tableName, name)
+	}
+	return nil, value, nil
+}
+
+// isBatchOf 判断 b 是不是表名或别名为 tableName 的表中的数据
+func isBatchOf(b *memcore.Batch, tableName string) bool {
+	if b.Meta != nil && strings.EqualFold(b.Meta.Table, tableName) {
+		return true
+	}
+	for _, column := range b.Table.Columns {
+		if strings.EqualFold(column.TableName, tableName) || strings.EqualFold(column.TableAs, tableName) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareResult(op string, result int) bool {
+	switch op {
+	case sqlparser.EqualStr:
+		return result == 0
+	case sqlparser.NotEqualStr:
+		return result != 0
+	case sqlparser.LessThanStr:
+		return result < 0
+	case sqlparser.LessEqualStr:
+		return result <= 0
+	case sqlparser.GreaterThanStr:
+		return result > 0
+	default:
+		return result >= 0
+	}
+}
+
+// compareValues 同 vm.Equal, vm.LessThan 等
+func compareValues(op string, left, right vm.Value) (bool, error) {
+	switch op {
+	case sqlparser.EqualStr:
+		return left.EqualTo(right, vm.EmptyCompareOption())
+	case sqlparser.NotEqualStr:
+		ok, err := left.EqualTo(right, vm.EmptyCompareOption())
+		if err != nil {
+			return false, err
+		}
+		return !ok, nil
+	default:
+		result, err := left.CompareTo(right, vm.EmptyCompareOption())
+		if err != nil {
+			return false, err
+		}
+		return compareResult(op, result), nil
+	}
+}
+
+func compareInt(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// compareVector 比较 rows 中每一行的值和 value, 整数列和字符串列的等值比较不需要转换为 Value
+func compareVector(op string, vector *memcore.Vector, value vm.Value, columnOnLeft bool, rows []int) ([]int, error) {
+	matched := make([]int, 0, len(rows))
+	compareOne := func(row int) (bool, error) {
+		if columnOnLeft {
+			return compareValues(op, vector.Get(row), value)
+		}
+		return compareValues(op, value, vector.Get(row))
+	}
+
+	switch {
+	case vector.IsTyped() && vector.Type == vm.ValueInt64 && value.Type == vm.ValueInt64:
+		to := value.Int64
+		for _, row := range rows {
+			var ok bool
+			if vector.IsNull(row) {
+				var err error
+				ok, err = compareOne(row)
+				if err != nil {
+					return nil, err
+				}
+			} else if columnOnLeft {
+				ok = compareResult(op, compareInt(vector.Ints[row], to))
+			} else {
+				ok = compareResult(op, compareInt(to, vector.Ints[row]))
+			}
+			if ok {
+				matched = append(matched, row)
+			}
+		}
+	case vector.IsTyped() && vector.Type == vm.ValueString && value.Type == vm.ValueString &&
+		(op == sqlparser.EqualStr || op == sqlparser.NotEqualStr):
+		to := value.Str
+		for _, row := range rows {
+			var ok bool
+			if vector.IsNull(row) {
+				var err error
+				ok, err = compareOne(row)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				ok = (vector.Strs[row] == to) == (op == sqlparser.EqualStr)
+			}
+			if ok {
+				matched = append(matched, row)
+			}
+		}
+	default:
+		for _, row := range rows {
+			ok, err := compareOne(row)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matched = append(matched, row)
+			}
+		}
+	}
+	return matched, nil
+}
+
+// exceptRows 返回 rows 中不在 matched 中的行, matched 是 rows 的子集
+func exceptRows(rows, matched []int) []int {
+	results := make([]int, 0, len(rows)-len(matched))
+	i := 0
+	for _, row := range rows {
+		if i < len(matched) && matched[i] == row {
+			i++
+			continue
+		}
+		results = append(results, row)
+	}
+	return results
+}
+
+// mergeRows 合并两个没有交集的有序行号列表
+func mergeRows(a, b []int) []int {
+	results := make([]int, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] < b[j] {
+			results = append(results, a[i])
+			i++
+		} else {
+			results = append(results, b[j])
+			j++
+		}
+	}
+	results = append(results, a[i:]...)
+	return append(results, b[j:]...)
+}
+
+// batchAggregate 是按列执行的 count, sum 和 avg, name 为空时表示 *.
+// 它只描述聚合函数, 累加的状态在每次 Iterate 时用 vm.AggFuncs 创建, 所以同一个查询可以并发执行
+type batchAggregate struct {
+	funcName  string
+	tableName string
+	name      string
+}
+
+// toBatchAggregates 判断 select 语句是否只是对一个表的 count, sum 和 avg, 是的话返回它们的列名和聚合函数
+func toBatchAggregates(stmt *sqlparser.Select) ([]string, []batchAggregate, bool) {
+	if len(stmt.From) != 1 || stmt.GroupBy != nil || stmt.Having != nil ||
+		stmt.OrderBy != nil || stmt.Limit != nil || len(stmt.SelectExprs) == 0 {
+		return nil, nil, false
+	}
+	if _, ok := stmt.From[0].(*sqlparser.AliasedTableExpr); !ok {
+		return nil, nil, false
+	}
+
+	var names []string
+	var aggregates []batchAggregate
+	for _, selectExpr := range stmt.SelectExprs {
+		v, ok := selectExpr.(*sqlparser.AliasedExpr)
+		if !ok {
+			return nil, nil, false
+		}
+		funcExpr, ok := v.Expr.(*sqlparser.FuncExpr)
+		if !ok || funcExpr.Distinct || len(funcExpr.Exprs) != 1 {
+			return nil, nil, false
+		}
+		agg := batchAggregate{funcName: funcExpr.Name.Lowered()}
+		if _, ok := vm.AggFuncs[agg.funcName]; !ok {
+			return nil, nil, false
+		}
+		switch arg := funcExpr.Exprs[0].(type) {
+		case *sqlparser.StarExpr:
+		case *sqlparser.AliasedExpr:
+			column, ok := arg.Expr.(*sqlparser.ColName)
+			if !ok {
+				return nil, nil, false
+			}
+			agg.tableName, agg.name = toColumnName(column)
+		default:
+			return nil, nil, false
+		}
+
+		if v.As.IsEmpty() {
+			names = append(names, sqlparser.String(v))
+		} else {
+			names = append(names, v.As.String())
+		}
+		aggregates = append(aggregates, agg)
+	}
+	return names, aggregates, true
+}
+
+// aggregate 将一批数据累加到 aggregator 中, 累加的顺序和按行执行时相同, 所以浮点数的结果也相同
+func (agg batchAggregate) aggregate(aggregator vm.Aggregator, b *memcore.Batch) error {
+	n := b.Length()
+	if n == 0 {
+		return nil
+	}
+	if agg.name == "" {
+		// count(*) 中每一行的值都是 1
+		for idx := 0; idx < n; idx++ {
+			if err := aggregator.Agg(vm.IntToValue(1)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	vector, constant, err := batchColumn(b, agg.tableName, agg.name, false)
+	if err != nil {
+		return err
+	}
+	for idx := 0; idx < n; idx++ {
+		value := constant
+		if vector != nil {
+			value = vector.Get(b.Row(idx))
+		}
+		if err := aggregator.Agg(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// executeBatchAggregates 按列计算聚合函数, query 不能按列读取时使用按行计算的 rowQuery
+func executeBatchAggregates(query, rowQuery memcore.Query, names []string, aggregates []batchAggregate) memcore.Query {
+	return memcore.Query{
+		Iterate: func() memcore.Iterator {
+			batches, err := query.ReadBatches()
+			if err != nil {
+				if errors.Is(err, memcore.ErrNoBatches) {
+					return rowQuery.Iterate()
+				}
+				return func(memcore.Context) (memcore.Record, error) {
+					return memcore.Record{}, err
+				}
+			}
+
+			var result memcore.Record
+			for idx, agg := range aggregates {
+				aggregator := vm.AggFuncs[agg.funcName]()
+				for bidx := range batches {
+					if err := agg.aggregate(aggregator, &batches[bidx]); err != nil {
+						return func(memcore.Context) (memcore.Record, error) {
+							return memcore.Record{}, err
+						}
+					}
+				}
+				value, err := aggregator.Result()
+				if err != nil {
+					return func(memcore.Context) (memcore.Record, error) {
+						return memcore.Record{}, err
+					}
+				}
+				result.Columns = append(result.Columns, memcore.Column{Name: names[idx]})
+				result.Values = append(result.Values, value)
+			}
+			return memcore.FromRecords([]memcore.Record{result}).Iterate()
+		},
+	}
+}
+
+// renameBatchToAlias 同 RenameTableToAlias
+func renameBatchToAlias(alias string) func(memcore.Batch) (memcore.Batch, error) {
+	return func(b memcore.Batch) (memcore.Batch, error) {
+		table := *b.Table
+		table.Columns = make([]Column, len(b.Table.Columns))
+		copy(table.Columns, b.Table.Columns)
+		for idx := range table.Columns {
+			table.Columns[idx].TableAs = alias
+		}
+		b.Table = &table
+		return b, nil
+	}
+}
@@ -2,10 +2,12 @@ package vm
 
 import (
 	"errors"
+	"time"
 )
 
 var Funcs = map[string]func(ctx Context, values []Value) (Value, error){
 	"round": Round,
+	"now":   Now,
 }
 
 func CallFunc(call func(Context, []Value) (Value, error), readValues func(Context) ([]Value, error)) func(ctx Context) (Value, error) {
@@ -58,6 +60,13 @@ func Round(ctx Context, values []Value) (Value, error) {
 	return xValue.Round(decimaldigits)
 }
 
+func Now(ctx Context, values []Value) (Value, error) {
+	if len(values) != 0 {
+		return Null(), newArgumentError("now", "now argument isnot match")
+	}
+	return DatetimeToValue(time.Now()), nil
+}
+
 func newArgumentError(name string, msg string) error {
 	return errors.New(msg)
 }